@@ -0,0 +1,59 @@
+// nftables-agent applies the set operations of the nftables plugin with "backend remote" on the firewall host.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	coredns_nftables "github.com/owent/coredns-nftables"
+)
+
+func main() {
+	listen := flag.String("listen", "unix:///run/coredns-nftables.sock", "address to listen, unix:///path/to/socket or tcp://host:port")
+	tlsCert := flag.String("tls-cert", "", "certificate of the agent, required by tcp://")
+	tlsKey := flag.String("tls-key", "", "private key of the agent, required by tcp://")
+	tlsCA := flag.String("tls-ca", "", "CA which signs the certificates of clients, required by tcp://")
+	backend := flag.String("backend", "netlink", "backend to apply operations, netlink or nft")
+	nftBinary := flag.String("nft", "nft", "path of nft, used by -backend nft")
+	nftFlush := flag.Duration("nft-flush", time.Duration(0), "interval to merge batches of clients, used by -backend nft")
+	flag.Parse()
+
+	switch *backend {
+	case "netlink":
+	case "nft":
+		coredns_nftables.SetNftCliBackend(*nftBinary, *nftFlush)
+	default:
+		log.Fatalf("backend %v invalid, only netlink and nft are supported", *backend)
+	}
+
+	var tlsConfig *tls.Config
+	if *tlsCert != "" || *tlsKey != "" || *tlsCA != "" {
+		var err error
+		if tlsConfig, err = coredns_nftables.NewRemoteTLSConfig(*tlsCert, *tlsKey, *tlsCA); err != nil {
+			log.Fatalf("load tls failed: %v", err)
+		}
+	}
+
+	agent := coredns_nftables.NewNftablesAgent(nil)
+	listener, err := agent.Listen(*listen, tlsConfig)
+	if err != nil {
+		log.Fatalf("listen %v failed: %v", *listen, err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		agent.Close()
+	}()
+
+	log.Printf("nftables agent listen on %v", *listen)
+	if err := agent.Serve(listener); err != nil {
+		log.Fatalf("serve %v failed: %v", *listen, err)
+	}
+}
@@ -25,4 +25,18 @@ var recordDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 	Help:      "Histogram of the time each record took.",
 }, []string{"server"})
 
+var unvalidatedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "unvalidated_count_total",
+	Help:      "Counter of rules which rejected a response because it's not validated by DNSSEC.",
+}, []string{"server"})
+
+var reinsertCount = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: plugin.Namespace,
+	Subsystem: "nftables",
+	Name:      "monitor_reinsert_count_total",
+	Help:      "Counter of elements added again after their tables or sets are deleted by others.",
+})
+
 var _ sync.Once
@@ -3,11 +3,14 @@ package coredns_nftables
 import (
 	"context"
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/metrics"
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
 	"github.com/coredns/coredns/plugin/pkg/nonwriter"
+	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 
 	"github.com/google/nftables"
@@ -15,8 +18,13 @@ import (
 
 var asyncMode bool = false
 
+var ipv4TableFamilies = []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyINet, nftables.TableFamilyBridge}
+var ipv6TableFamilies = []nftables.TableFamily{nftables.TableFamilyIPv6, nftables.TableFamilyINet, nftables.TableFamilyBridge}
+
 type NftablesRuleSet struct {
 	RuleAddElement []*NftablesSetAddElement
+	RuleAddSpf     []*NftablesSetAddElement
+	RuleAddClient  []*NftablesSetAddElement
 }
 
 // NftablesHandler implements the plugin.Handler interface.
@@ -24,16 +32,51 @@ type NftablesHandler struct {
 	Next plugin.Handler
 
 	Rules map[nftables.TableFamily]*NftablesRuleSet
+	// EcsTrustedForwarders are the forwarders whose EDNS Client Subnet option is used as the client
+	EcsTrustedForwarders []*net.IPNet
+	// Excludes are the addresses which are never added by any rule
+	Excludes []*net.IPNet
+	// GeoIP is the MaxMind databases used by rules of this handler
+	GeoIP *NftablesGeoIP
+	// Definitions are the tables, sets and chains created at startup
+	Definitions NftablesDefinitions
+}
+
+// NftablesQuery is the query of a DNS response which rules match
+type NftablesQuery struct {
+	Name              string
+	QType             uint16
+	Rcode             int
+	AuthenticatedData bool
+	Client            *net.IPNet
+	// unvalidatedRules are the rules which rejected the response, they're only counted and logged once
+	unvalidatedRules map[*NftablesSetAddElement]bool
+}
+
+func NewNftablesQuery(r *dns.Msg, client *net.IPNet) *NftablesQuery {
+	query := &NftablesQuery{Rcode: r.Rcode, AuthenticatedData: r.AuthenticatedData, Client: client, unvalidatedRules: make(map[*NftablesSetAddElement]bool)}
+	if len(r.Question) > 0 {
+		query.Name = r.Question[0].Name
+		query.QType = r.Question[0].Qtype
+	}
+	return query
 }
 
 func NewNftablesHandler() NftablesHandler {
 	return NftablesHandler{
 		Next:  nil,
 		Rules: make(map[nftables.TableFamily]*NftablesRuleSet),
+		GeoIP: &NftablesGeoIP{},
 	}
 }
 
-func (m *NftablesHandler) ServeWorker(ctx context.Context, r *dns.Msg) (int, error) {
+func (m *NftablesHandler) ServeWorker(ctx context.Context, r *dns.Msg, client *net.IPNet) (int, error) {
+	query := NewNftablesQuery(r, client)
+	if !m.matchAnyResponse(query) {
+		log.Debugf("Ignore %v %v(%v) because no rule match its qtype and rcode", query.Name, dns.TypeToString[query.QType], dns.RcodeToString[query.Rcode])
+		return 0, nil
+	}
+
 	cache, err := NewCache()
 	if err != nil {
 		log.Errorf("NewCache failed, %v", err)
@@ -46,27 +89,59 @@ func (m *NftablesHandler) ServeWorker(ctx context.Context, r *dns.Msg) (int, err
 	}()
 	defer exportRecordDuration(ctx, time.Now())
 
+	resolved := make(map[string][]dns.RR)
 	applyCounter := 0
+	// Answers are marked by the lru after their operations are committed
+	var lruAnswers []dns.RR
+	// Members of exclusive groups are recorded as holders of addresses after their operations are committed
+	var exclusiveAdds []exclusiveAdd
 	for _, answer := range r.Answer {
 		var tableFamilies []nftables.TableFamily
 
+		if txt, ok := answer.(*dns.TXT); ok {
+			applyCounter += m.serveSpf(ctx, cache, txt, query)
+			continue
+		}
+		if answer.Header().Rrtype == dns.TypeMX || answer.Header().Rrtype == dns.TypeNS {
+			applyCounter += m.serveResolve(ctx, cache, answer, query, resolved)
+			continue
+		}
+
+		// Reverse lookups are matched by the PTR target and apply the address in the query name
+		answerQuery := query
+		fromPtr := false
+		if ptr, ok := answer.(*dns.PTR); ok {
+			answer = newAnswerFromPtr(ptr)
+			if answer == nil {
+				continue
+			}
+			ptrQuery := *query
+			ptrQuery.Name = ptr.Ptr
+			answerQuery = &ptrQuery
+			fromPtr = true
+		}
+
 		switch answer.Header().Rrtype {
 		case dns.TypeA:
 			{
-				if cache.LruIgnoreIp(&answer) {
+				if m.isExcludedAddress(answer.(*dns.A).A) {
+					log.Debugf("Ignore ip element %v(%v) because it's excluded", answer.(*dns.A).A.String(), answer.Header().Name)
+				} else if cache.LruIgnoreIp(&answer) {
 					log.Debugf("Ignore ip element %v(%v) because lru max retry times exceeded", answer.(*dns.A).A.String(), answer.Header().Name)
 				} else {
 					recordCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
-					tableFamilies = []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyINet, nftables.TableFamilyBridge}
+					tableFamilies = ipv4TableFamilies
 				}
 			}
 		case dns.TypeAAAA:
 			{
-				if cache.LruIgnoreIp(&answer) {
+				if m.isExcludedAddress(answer.(*dns.AAAA).AAAA) {
+					log.Debugf("Ignore ip element %v(%v) because it's excluded", answer.(*dns.AAAA).AAAA.String(), answer.Header().Name)
+				} else if cache.LruIgnoreIp(&answer) {
 					log.Debugf("Ignore ip element %v(%v) because lru max retry times exceeded", answer.(*dns.AAAA).AAAA.String(), answer.Header().Name)
 				} else {
 					recordCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
-					tableFamilies = []nftables.TableFamily{nftables.TableFamilyIPv6, nftables.TableFamilyINet, nftables.TableFamilyBridge}
+					tableFamilies = ipv6TableFamilies
 				}
 			}
 		default:
@@ -80,10 +155,32 @@ func (m *NftablesHandler) ServeWorker(ctx context.Context, r *dns.Msg) (int, err
 		}
 
 		hasError := false
+		cache.answer = answerAddress(answer).String()
 		for _, family := range tableFamilies {
 			ruleSet, ok := m.Rules[family]
 			if ok {
+				var matched []*NftablesSetAddElement
 				for _, rule := range ruleSet.RuleAddElement {
+					// Only rules with a domain selector apply to addresses from reverse lookups
+					if (fromPtr && len(rule.Domains) == 0) || !rule.Match(ctx, answerQuery) {
+						continue
+					}
+					// A member of exclusive group only wins when it would add the address
+					if rule.ExclusiveGroup != "" && !rule.MatchAddress(cache, family, answerAddress(answer)) {
+						continue
+					}
+					matched = append(matched, rule)
+				}
+
+				matched = skipHeldExclusiveRules(ruleSet.RuleAddElement, matched, family, answerAddress(answer))
+				rules, removeRules := selectExclusiveRules(ruleSet.RuleAddElement, matched)
+				for _, rule := range removeRules {
+					if err := rule.ServeDeleteIP(ctx, cache, answerAddress(answer), family); err != nil {
+						hasError = true
+						log.Errorf("Delete element %v(%v) from %v %v %v failed.%v", answerAddress(answer).String(), answer.Header().Name, cache.GetFamilyName(family), rule.TableName, rule.SetName, err)
+					}
+				}
+				for _, rule := range rules {
 					err, ignored := rule.ServeDNS(ctx, cache, &answer, family)
 					if err != nil {
 						hasError = true
@@ -97,23 +194,50 @@ func (m *NftablesHandler) ServeWorker(ctx context.Context, r *dns.Msg) (int, err
 						}
 					} else if !ignored {
 						applyCounter += 1
+						if rule.ExclusiveGroup != "" {
+							exclusiveAdds = append(exclusiveAdds, exclusiveAdd{rule: rule, family: family, ip: answerAddress(answer)})
+						}
 					}
 				}
 			}
 		}
 
+		cache.answer = ""
 		if !hasError {
+			lruAnswers = append(lruAnswers, answer)
+		}
+	}
+
+	applyCounter += m.serveClient(ctx, cache, query)
+
+	// All operations of this response are committed in one batch, failed ones are not counted
+	failedAnswers := make(map[string]bool)
+	for _, op := range commitOperations(cache) {
+		if op.counted {
+			applyCounter -= 1
+		}
+		if op.Answer != "" {
+			failedAnswers[op.Answer] = true
+		}
+	}
+	for _, answer := range lruAnswers {
+		if !failedAnswers[answerAddress(answer).String()] {
 			cache.LruUpdateIp(&answer, applyCounter)
 		}
 	}
+	for _, add := range exclusiveAdds {
+		if !failedAnswers[add.ip.String()] {
+			add.rule.recordExclusiveHolder(add.family, add.ip)
+		}
+	}
 
 	return applyCounter, err
 }
 
-func (m *NftablesHandler) Serve(ctx context.Context, r *dns.Msg, nextPluginCost time.Duration) error {
+func (m *NftablesHandler) Serve(ctx context.Context, r *dns.Msg, client *net.IPNet, nextPluginCost time.Duration) error {
 	startTime := time.Now()
 
-	applyCounter, err := m.ServeWorker(ctx, r)
+	applyCounter, err := m.ServeWorker(ctx, r, client)
 
 	endTime := time.Now()
 
@@ -129,6 +253,8 @@ func (m *NftablesHandler) Name() string { return "nftables" }
 
 func (m *NftablesHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	startTime := time.Now()
+	client := m.clientNetwork(&request.Request{W: w, Req: r})
+
 	nw := nonwriter.New(w)
 	rcode, err := plugin.NextOrFailure(m.Name(), m.Next, ctx, nw, r)
 	if err != nil {
@@ -142,13 +268,13 @@ func (m *NftablesHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r
 
 	hasValidRecord := false
 	for _, answer := range r.Answer {
-		if answer.Header().Rrtype == dns.TypeA || answer.Header().Rrtype == dns.TypeAAAA {
+		if m.isValidAnswer(answer) {
 			hasValidRecord = true
 			break
 		}
 	}
-	if !hasValidRecord {
-		log.Debug("Request didn't contain any answer or A/AAAA record")
+	if !hasValidRecord && !m.hasClientRule() {
+		log.Debug("Request didn't contain any answer or record to apply")
 		err = w.WriteMsg(r)
 		if err != nil {
 			return dns.RcodeFormatError, err
@@ -161,8 +287,10 @@ func (m *NftablesHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r
 		copyMsg := r.Copy()
 		err = w.WriteMsg(r)
 
+		// Keep values of the request context (server, metadata), but not its cancellation
+		asyncCtx := context.WithoutCancel(ctx)
 		go func() {
-			if serveErr := m.Serve(context.Background(), copyMsg, endTime.Sub(startTime)); serveErr != nil {
+			if serveErr := m.Serve(asyncCtx, copyMsg, client, endTime.Sub(startTime)); serveErr != nil {
 				log.Errorf("Async Serve failed, %v", serveErr)
 			}
 		}()
@@ -170,7 +298,7 @@ func (m *NftablesHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r
 			return dns.RcodeServerFailure, err
 		}
 	} else {
-		if serveErr := m.Serve(context.Background(), r, endTime.Sub(startTime)); serveErr != nil {
+		if serveErr := m.Serve(ctx, r, client, endTime.Sub(startTime)); serveErr != nil {
 			log.Errorf("Serve failed, %v", serveErr)
 		}
 		if writeErr := w.WriteMsg(r); writeErr != nil {
@@ -181,6 +309,47 @@ func (m *NftablesHandler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r
 	return rcode, nil
 }
 
+// matchAnyResponse reports whether the qtype and rcode of query match any rule
+func (m *NftablesHandler) matchAnyResponse(query *NftablesQuery) bool {
+	for _, ruleSet := range m.Rules {
+		for _, rules := range [][]*NftablesSetAddElement{ruleSet.RuleAddElement, ruleSet.RuleAddSpf, ruleSet.RuleAddClient} {
+			for _, rule := range rules {
+				if rule.MatchResponse(query) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// isValidAnswer reports whether answer may be applied by any rule
+func (m *NftablesHandler) isValidAnswer(answer dns.RR) bool {
+	switch answer.Header().Rrtype {
+	case dns.TypeA, dns.TypeAAAA:
+		return true
+	case dns.TypePTR:
+		return m.hasReverseRule()
+	case dns.TypeTXT:
+		return m.hasSpfRule()
+	case dns.TypeMX, dns.TypeNS:
+		return m.hasResolveRule(answer.Header().Rrtype)
+	}
+	return false
+}
+
+// hasReverseRule reports whether any rule applies to the addresses of reverse lookups, which requires domain
+func (m *NftablesHandler) hasReverseRule() bool {
+	for _, ruleSet := range m.Rules {
+		for _, rule := range ruleSet.RuleAddElement {
+			if len(rule.Domains) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (m *NftablesHandler) MutableRuleSet(family nftables.TableFamily) *NftablesRuleSet {
 	ret, ok := m.Rules[family]
 	if ok {
@@ -192,6 +361,55 @@ func (m *NftablesHandler) MutableRuleSet(family nftables.TableFamily) *NftablesR
 	}
 }
 
+// allRules returns the rules of all families, a rule of more than one family is returned once
+func (m *NftablesHandler) allRules() []*NftablesSetAddElement {
+	var ret []*NftablesSetAddElement
+	visited := make(map[*NftablesSetAddElement]bool)
+	for _, ruleSet := range m.Rules {
+		for _, rules := range [][]*NftablesSetAddElement{ruleSet.RuleAddElement, ruleSet.RuleAddSpf, ruleSet.RuleAddClient} {
+			for _, rule := range rules {
+				if !visited[rule] {
+					visited[rule] = true
+					ret = append(ret, rule)
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// answerAddress returns the address of an A or AAAA answer
+func answerAddress(answer dns.RR) net.IP {
+	switch rr := answer.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
+
+// newAnswerFromPtr converts a PTR answer into an A or AAAA record of the
+// address encoded in its owner name, named by the PTR target.
+func newAnswerFromPtr(ptr *dns.PTR) dns.RR {
+	ip := net.ParseIP(dnsutil.ExtractAddressFromReverse(ptr.Hdr.Name))
+	if ip == nil {
+		return nil
+	}
+
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return &dns.A{
+			Hdr: dns.RR_Header{Name: ptr.Ptr, Rrtype: dns.TypeA, Class: ptr.Hdr.Class, Ttl: ptr.Hdr.Ttl},
+			A:   ipv4,
+		}
+	}
+
+	return &dns.AAAA{
+		Hdr:  dns.RR_Header{Name: ptr.Ptr, Rrtype: dns.TypeAAAA, Class: ptr.Hdr.Class, Ttl: ptr.Hdr.Ttl},
+		AAAA: ip,
+	}
+}
+
 func exportRecordDuration(ctx context.Context, start time.Time) {
 	recordDuration.WithLabelValues(metrics.WithServer(ctx)).
 		Observe(float64(time.Since(start).Microseconds()))
@@ -0,0 +1,82 @@
+package coredns_nftables
+
+import (
+	"github.com/google/nftables"
+	"github.com/vishvananda/netns"
+)
+
+// NftablesBackend is the part of *nftables.Conn used by the plugin. Modifications are queued
+// until Flush, which commits them in one batch, while lookups are sent immediately.
+type NftablesBackend interface {
+	ListTablesOfFamily(family nftables.TableFamily) ([]*nftables.Table, error)
+	AddTable(t *nftables.Table) *nftables.Table
+	GetSetByName(t *nftables.Table, name string) (*nftables.Set, error)
+	AddSet(s *nftables.Set, vals []nftables.SetElement) error
+	SetAddElements(s *nftables.Set, vals []nftables.SetElement) error
+	SetDeleteElements(s *nftables.Set, vals []nftables.SetElement) error
+	GetSetElements(s *nftables.Set) ([]nftables.SetElement, error)
+	Flush() error
+}
+
+var _ NftablesBackend = (*nftables.Conn)(nil)
+
+// NftablesBatchDiscarder is implemented by backends which can drop the queued modifications without committing them
+type NftablesBatchDiscarder interface {
+	Discard() error
+}
+
+// NftablesBatchImmediateFlusher is implemented by backends whose Flush waits to merge batches, FlushNow commits
+// the queued modifications without waiting
+type NftablesBatchImmediateFlusher interface {
+	FlushNow() error
+}
+
+// netlinkBackend is a *nftables.Conn, which drops the queued messages by replacing the connection.
+// A connection which is not lasting has no other state, and it opens a netlink socket for every request.
+type netlinkBackend struct {
+	*nftables.Conn
+	options []nftables.ConnOption
+}
+
+func newNetlinkBackend(options ...nftables.ConnOption) (*netlinkBackend, error) {
+	c, err := nftables.New(options...)
+	if err != nil {
+		return nil, err
+	}
+	return &netlinkBackend{Conn: c, options: options}, nil
+}
+
+func (c *netlinkBackend) Discard() error {
+	conn, err := nftables.New(c.options...)
+	if err != nil {
+		return err
+	}
+	c.Conn = conn
+	return nil
+}
+
+// NftablesBackendFactory opens a new connection of the pool in NewCache
+type NftablesBackendFactory func() (NftablesBackend, netns.NsHandle, error)
+
+var nftablesBackendFactory NftablesBackendFactory = openSystemNFTBackend
+
+func openSystemNFTBackend() (NftablesBackend, netns.NsHandle, error) {
+	c, newNS, err := openSystemNFTConn()
+	if err != nil {
+		return nil, newNS, err
+	}
+	return c, newNS, nil
+}
+
+// SetNftablesBackendFactory replaces the connections of new caches, nil restores the netlink connections.
+// Connections in the pool are not affected, call ClearCache to drop them.
+// Network namespaces are only supported by netlink, use SetNftablesNetnsBackendFactory to replace them after this.
+func SetNftablesBackendFactory(factory NftablesBackendFactory) {
+	if factory == nil {
+		factory = openSystemNFTBackend
+		nftablesNetnsBackendFactory = openSystemNFTBackendOfNetns
+	} else {
+		nftablesNetnsBackendFactory = unsupportedNetnsBackend
+	}
+	nftablesBackendFactory = factory
+}
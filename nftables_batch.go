@@ -0,0 +1,173 @@
+package coredns_nftables
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/google/nftables"
+)
+
+// NftablesOperation is a modification of a set queued by rules, which is committed with the others of a response in one batch
+type NftablesOperation struct {
+	// CreateSet creates the table and Set with Elements
+	CreateSet bool
+	Delete    bool
+	Set       *nftables.Set
+	Elements  []nftables.SetElement
+	// Text is the address or network of Elements
+	Text string
+	// Err is the reason why the operation is not committed
+	Err error
+	// Answer is the address of the answer which queued the operation, empty for other elements
+	Answer string
+	// counted is true when the operation is counted as an applied element
+	counted bool
+	// addTable queues the table of a created set, when it's committed by another connection
+	addTable bool
+}
+
+func (op *NftablesOperation) String() string {
+	family := nftCliFamily(op.Set.Table.Family)
+	if op.CreateSet {
+		return fmt.Sprintf("create set %v %v %v with element %v", family, op.Set.Table.Name, op.Set.Name, op.Text)
+	}
+	if op.Delete {
+		return fmt.Sprintf("delete element %v from set %v %v %v", op.Text, family, op.Set.Table.Name, op.Set.Name)
+	}
+	return fmt.Sprintf("add element %v into set %v %v %v", op.Text, family, op.Set.Table.Name, op.Set.Name)
+}
+
+// queue appends the operation to the batch of conn. The table of a created set is queued by MutableNftablesTable,
+// and it's only queued again with addTable when the operation is committed alone.
+func (op *NftablesOperation) queue(conn NftablesBackend, addTable bool) error {
+	if op.CreateSet {
+		if addTable || op.addTable {
+			conn.AddTable(op.Set.Table)
+		}
+		return conn.AddSet(op.Set, op.Elements)
+	}
+	if op.Delete {
+		return conn.SetDeleteElements(op.Set, op.Elements)
+	}
+	return conn.SetAddElements(op.Set, op.Elements)
+}
+
+// queueOperation delays op until Commit, a created set is returned by GetSet before it's committed.
+// An operation queued again by the coalescer keeps the answer of the request which queued it first.
+func (cache *NftablesCache) queueOperation(op *NftablesOperation) {
+	if op.Answer == "" {
+		root := cache
+		for root.parent != nil {
+			root = root.parent
+		}
+		op.Answer = root.answer
+	}
+	cache.operations = append(cache.operations, op)
+	if op.CreateSet {
+		if cache.pendingSets == nil {
+			cache.pendingSets = make(map[NftablesSetReference]*nftables.Set)
+		}
+		cache.pendingSets[NftablesSetReference{Family: op.Set.Table.Family, TableName: op.Set.Table.Name, SetName: op.Set.Name}] = op.Set
+	}
+}
+
+// Commit flushes the queued operations of this cache and its namespaces, in one batch of every connection.
+// A batch is atomic, so when it fails, the operations are committed one by one and the failed ones are returned.
+func (cache *NftablesCache) Commit() []*NftablesOperation {
+	var failed []*NftablesOperation
+	for key, child := range cache.namespaces {
+		failed = append(failed, child.commit()...)
+		if child.HasNftableConnectionError {
+			delete(cache.namespaces, key)
+			child.destroy()
+		}
+	}
+	return append(failed, cache.commit()...)
+}
+
+func (cache *NftablesCache) commit() []*NftablesOperation {
+	operations := cache.operations
+	cache.operations = nil
+	cache.pendingSets = nil
+
+	conn := cache.NftableConnection
+	var err error
+	for _, op := range operations {
+		if err = op.queue(conn, false); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		if err = conn.Flush(); err == nil {
+			return nil
+		}
+	} else if discardErr := discardBatch(conn); discardErr != nil {
+		// The partial batch can't be dropped, so it's destroyed with the connection and nothing is replayed
+		log.Errorf("Nftables drop batch of %v operation(s) failed, %v. %v", len(operations), err, discardErr)
+		cache.HasNftableConnectionError = true
+		for _, op := range operations {
+			op.Err = err
+		}
+		return operations
+	}
+
+	if len(operations) <= 1 {
+		log.Errorf("Nftables Flush connection failed %v", err)
+		if !isNftablesOperationError(err) {
+			cache.HasNftableConnectionError = true
+		}
+		for _, op := range operations {
+			op.Err = err
+		}
+		return operations
+	}
+
+	log.Warningf("Nftables commit %v operation(s) in one batch failed, commit them one by one. %v", len(operations), err)
+	var failed []*NftablesOperation
+	for i, op := range operations {
+		err := op.queue(conn, true)
+		if err == nil {
+			err = flushNow(conn)
+			if err != nil && !isNftablesOperationError(err) {
+				cache.HasNftableConnectionError = true
+			}
+		} else if discardErr := discardBatch(conn); discardErr != nil {
+			log.Errorf("Nftables drop batch of %v failed, %v. %v", op.String(), err, discardErr)
+			cache.HasNftableConnectionError = true
+			for _, op := range operations[i:] {
+				op.Err = err
+			}
+			return append(failed, operations[i:]...)
+		}
+		if err != nil {
+			op.Err = err
+			failed = append(failed, op)
+			log.Errorf("Nftables %v failed. %v", op.String(), err)
+		}
+	}
+	return failed
+}
+
+// flushNow commits the modifications queued in conn without waiting to merge them with other batches
+func flushNow(conn NftablesBackend) error {
+	if flusher, ok := conn.(NftablesBatchImmediateFlusher); ok {
+		return flusher.FlushNow()
+	}
+	return conn.Flush()
+}
+
+// discardBatch drops the modifications queued in conn, which fails when conn can't drop them
+func discardBatch(conn NftablesBackend) error {
+	discarder, ok := conn.(NftablesBatchDiscarder)
+	if !ok {
+		return fmt.Errorf("backend %T can't drop queued modifications", conn)
+	}
+	return discarder.Discard()
+}
+
+// isNftablesOperationError reports whether err rejects an operation, rather than a failure of the connection
+func isNftablesOperationError(err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) && errno != syscall.ENOBUFS && errno != syscall.EPERM
+}
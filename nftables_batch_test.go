@@ -0,0 +1,163 @@
+package coredns_nftables
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+	"github.com/vishvananda/netns"
+)
+
+func TestCommitOneBatch(t *testing.T) {
+	handle, ruleset, _, batches := newCountingTestHandler(t, `nftables ip ip6 {
+		set add element fw proxy auto false
+		set add element fw direct auto false
+	}`)
+
+	// Sets of both families are created and filled by one batch
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	r.Answer = append(r.Answer,
+		&dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")},
+		&dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.2")},
+		&dns.AAAA{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::1")})
+	applyCounter, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1")))
+	if err != nil || applyCounter != 6 {
+		t.Fatalf("Expected 6 elements applied, but got: %v, %v", applyCounter, err)
+	}
+	if batches.Load() != 1 {
+		t.Fatalf("Expected one batch, but got: %v", batches.Load())
+	}
+	for _, set := range []string{"proxy", "direct"} {
+		if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", set, net.ParseIP("192.0.2.2")) || !ruleset.Contains(nftables.TableFamilyIPv6, "fw", set, net.ParseIP("2001:db8::1")) {
+			t.Fatalf("Expected elements added into %v", set)
+		}
+	}
+}
+
+func TestCommitAttributeErrors(t *testing.T) {
+	ruleset := withMemoryBackend(t)
+	conn := ruleset.Open()
+	table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"})
+	conn.AddSet(&nftables.Set{Table: table, Name: "mac", KeyType: nftables.TypeEtherAddr}, nil)
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		set add element fw proxy ip false
+		set add element fw mac ip false domain bad.example.org
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	// The set of ether_addr fails the batch, but elements of the other set are still added
+	r := new(dns.Msg)
+	r.SetQuestion("bad.example.org.", dns.TypeA)
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "bad.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")})
+	applyCounter, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1")))
+	if err != nil || applyCounter != 1 {
+		t.Fatalf("Expected 1 element applied, but got: %v, %v", applyCounter, err)
+	}
+	if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Expected element added into proxy")
+	}
+
+	cache, _ := NewCache()
+	defer CloseCache(cache)
+	tableCache := cache.GetNftablesTable(nftables.TableFamilyIPv4, "fw")
+	set, _ := cache.GetSet(tableCache, "mac")
+	cache.SetAddElements(tableCache, set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}}, "192.0.2.1")
+	failed := cache.Commit()
+	if len(failed) != 1 || failed[0].Err == nil || failed[0].String() != "add element 192.0.2.1 into set ip fw mac" {
+		t.Fatalf("Expected the failed operation, but got: %v", failed)
+	}
+	if cache.HasNftableConnectionError {
+		t.Fatalf("Expected the connection kept when only an operation is rejected")
+	}
+}
+
+func TestCommitExclusiveGroupErrors(t *testing.T) {
+	ruleset := withMemoryBackend(t)
+	conn := ruleset.Open()
+	table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"})
+	conn.AddSet(&nftables.Set{Table: table, Name: "mac", KeyType: nftables.TypeEtherAddr}, nil)
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		set add element fw proxy ip false exclusive-group route priority 10
+		set add element fw mac ip false exclusive-group route
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	// The failed deletion from the other member is not counted as an applied element
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")})
+	applyCounter, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1")))
+	if err != nil || applyCounter != 1 {
+		t.Fatalf("Expected 1 element applied, but got: %v, %v", applyCounter, err)
+	}
+	if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Expected element added into proxy")
+	}
+}
+
+// rejectingBackend fails to queue the element rejected, like elements which netlink can't marshal
+type rejectingBackend struct {
+	*countingBackend
+	rejected net.IP
+}
+
+func (c *rejectingBackend) SetAddElements(s *nftables.Set, vals []nftables.SetElement) error {
+	if net.IP(vals[0].Key).Equal(c.rejected) {
+		return errors.New("marshal key 0: invalid")
+	}
+	return c.countingBackend.SetAddElements(s, vals)
+}
+
+func TestCommitDropsPartialBatch(t *testing.T) {
+	ruleset := withMemoryBackend(t)
+	conn := ruleset.Open()
+	table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"})
+	conn.AddSet(&nftables.Set{Table: table, Name: "proxy", KeyType: nftables.TypeIPAddr}, nil)
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	batches := &atomic.Int64{}
+	SetNftablesBackendFactory(func() (NftablesBackend, netns.NsHandle, error) {
+		return &rejectingBackend{countingBackend: &countingBackend{NftablesBackend: ruleset.Open(), lookups: &atomic.Int64{}, batches: batches}, rejected: net.ParseIP("192.0.2.9")}, 0, nil
+	})
+
+	cache, _ := NewCache()
+	defer CloseCache(cache)
+	tableCache := cache.GetNftablesTable(nftables.TableFamilyIPv4, "fw")
+	set, _ := cache.GetSet(tableCache, "proxy")
+	for _, ip := range []string{"192.0.2.1", "192.0.2.9", "192.0.2.2"} {
+		cache.SetAddElements(tableCache, set, []nftables.SetElement{{Key: net.ParseIP(ip).To4()}}, ip)
+	}
+
+	// The queued part of the batch is dropped, so every valid element is only committed once by the replay
+	failed := cache.Commit()
+	if len(failed) != 1 || failed[0].Text != "192.0.2.9" {
+		t.Fatalf("Expected the rejected operation failed, but got: %v", failed)
+	}
+	if batches.Load() != 2 || cache.HasNftableConnectionError {
+		t.Fatalf("Expected 2 batches without connection errors, but got: %v, %v", batches.Load(), cache.HasNftableConnectionError)
+	}
+	if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.2")) {
+		t.Fatalf("Expected valid elements added")
+	}
+}
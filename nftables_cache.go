@@ -2,6 +2,7 @@ package coredns_nftables
 
 import (
 	"container/list"
+	"io"
 	"sync"
 	"time"
 
@@ -9,6 +10,7 @@ import (
 	"github.com/google/nftables"
 	lru "github.com/hashicorp/golang-lru"
 	"github.com/miekg/dns"
+	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
 )
 
@@ -20,8 +22,18 @@ var setLruMaxRetryTimes int = 2147483647
 var setLruMaxCount int = 10000
 var setLruTimeout time.Duration = time.Hour * time.Duration(720)
 
+// setHandleTTL is how long a set found by GetSetByName is reused, 0 (default) disables the cache.
+// Handles are kept until tables are invalidated while the monitor is subscribed.
+var setHandleTTL time.Duration = 0
+
 type NftableCache struct {
 	table *nftables.Table
+	sets  map[string]*nftableSetHandle
+}
+
+type nftableSetHandle struct {
+	set      *nftables.Set
+	loadTime time.Time
 }
 
 type NftableIPCache struct {
@@ -32,10 +44,27 @@ type NftableIPCache struct {
 type NftablesCache struct {
 	tables                    map[nftables.TableFamily]*map[string]*NftableCache
 	recentlyIPCache           *lru.Cache
+	geoIPCache                *lru.Cache
 	CreateTimepoint           time.Time
-	NftableConnection         *nftables.Conn
+	NftableConnection         NftablesBackend
+	IPSetConnection           NftablesIPSetBackend
+	ipsetHeaders              map[string]*netlink.IPSetResult
+	RouteConnection           NftablesRouteBackend
+	routeLinks                map[string]int
 	NetworkNamespace          netns.NsHandle
 	HasNftableConnectionError bool
+	// netnsKey is the namespace of a cache in namespaces of its parent, empty means the namespace of CoreDNS
+	netnsKey   string
+	netns      *NftablesNetns
+	parent     *NftablesCache
+	namespaces map[string]*NftablesCache
+	// generation is the monitorGeneration when tables are loaded
+	generation uint64
+	// operations are committed in one batch by Commit, pendingSets are the sets created by them
+	operations  []*NftablesOperation
+	pendingSets map[NftablesSetReference]*nftables.Set
+	// answer is the address of the answer being served, operations queued for it carry it to attribute failures
+	answer string
 }
 
 func NewCache() (*NftablesCache, error) {
@@ -56,25 +85,32 @@ func NewCache() (*NftablesCache, error) {
 				}(cacheHead)
 			} else {
 				log.Debugf("Nftables connection select %p from pool", cacheHead)
+				if generation := monitorGeneration.Load(); cacheHead.generation != generation {
+					cacheHead.invalidate(generation)
+				}
 				cacheHead.gc()
 				return cacheHead, nil
 			}
 		}
 	}
 
-	c, newNS, err := openSystemNFTConn()
+	c, newNS, err := nftablesBackendFactory()
 	if err != nil {
 		return nil, err
 	}
 
 	lruCache, _ := lru.New(setLruMaxCount)
+	geoIPCache, _ := lru.New(setLruMaxCount)
 	ret := &NftablesCache{
 		tables:                    make(map[nftables.TableFamily]*map[string]*NftableCache),
 		recentlyIPCache:           lruCache,
+		geoIPCache:                geoIPCache,
 		CreateTimepoint:           time.Now(),
 		NftableConnection:         c,
+		ipsetHeaders:              make(map[string]*netlink.IPSetResult),
 		NetworkNamespace:          newNS,
 		HasNftableConnectionError: false,
+		generation:                monitorGeneration.Load(),
 	}
 
 	log.Infof("Nftables create new cache pool %p", ret)
@@ -162,17 +198,21 @@ func (cache *NftablesCache) gc() {
 func (cache *NftablesCache) destroy() error {
 	log.Infof("Nftables cache pool %p start to destroy", cache)
 
+	for _, child := range cache.namespaces {
+		child.destroy()
+	}
+	cache.namespaces = nil
+	cache.closeIPSetConnection()
+	cache.closeRouteConnection()
+	if closer, ok := cache.NftableConnection.(io.Closer); ok {
+		closer.Close()
+	}
 	cleanupSystemNFTConn(cache.NetworkNamespace)
 	return nil
 }
 
+// CloseCache returns cache to the pool, operations which are not committed by Commit are dropped
 func CloseCache(cache *NftablesCache) error {
-	err := cache.NftableConnection.Flush()
-	if err != nil {
-		log.Errorf("Nftables Flush connection failed %v", err)
-		cache.HasNftableConnectionError = true
-	}
-
 	if cache.HasNftableConnectionError || time.Since(cache.CreateTimepoint) > cacheExpiredDuration {
 		return cache.destroy()
 	}
@@ -203,7 +243,13 @@ func ClearCache() {
 	}
 }
 
-func (cache *NftablesCache) MutableNftablesTable(family nftables.TableFamily, tableName string) *NftableCache {
+// GetNftablesTable returns the table in kernel, or nil if it's not found
+func (cache *NftablesCache) GetNftablesTable(family nftables.TableFamily, tableName string) *NftableCache {
+	tableSet := cache.loadNftablesTables(family)
+	return (*tableSet)[tableName]
+}
+
+func (cache *NftablesCache) loadNftablesTables(family nftables.TableFamily) *map[string]*NftableCache {
 	tableSet, ok := (*cache).tables[family]
 	if !ok {
 		tableSetM := make(map[string]*NftableCache)
@@ -225,6 +271,39 @@ func (cache *NftablesCache) MutableNftablesTable(family nftables.TableFamily, ta
 		}
 	}
 
+	return tableSet
+}
+
+// GetSet returns the set of the table, which is cached for setHandleTTL, or until the monitor receives changes
+// while it's subscribed. Missing sets are not cached.
+func (cache *NftablesCache) GetSet(tableCache *NftableCache, setName string) (*nftables.Set, error) {
+	if set, ok := cache.pendingSets[NftablesSetReference{Family: tableCache.table.Family, TableName: tableCache.table.Name, SetName: setName}]; ok {
+		return set, nil
+	}
+	if setHandleTTL <= 0 {
+		return cache.NftableConnection.GetSetByName(tableCache.table, setName)
+	}
+
+	if handle, ok := tableCache.sets[setName]; ok {
+		if cache.monitored() || time.Since(handle.loadTime) < setHandleTTL {
+			return handle.set, nil
+		}
+		delete(tableCache.sets, setName)
+	}
+
+	set, err := cache.NftableConnection.GetSetByName(tableCache.table, setName)
+	if err != nil || set == nil {
+		return set, err
+	}
+	if tableCache.sets == nil {
+		tableCache.sets = make(map[string]*nftableSetHandle)
+	}
+	tableCache.sets[setName] = &nftableSetHandle{set: set, loadTime: time.Now()}
+	return set, nil
+}
+
+func (cache *NftablesCache) MutableNftablesTable(family nftables.TableFamily, tableName string) *NftableCache {
+	tableSet := cache.loadNftablesTables(family)
 	tableCache, ok := (*tableSet)[tableName]
 	if !ok {
 		tableCache = &NftableCache{
@@ -241,13 +320,16 @@ func (cache *NftablesCache) MutableNftablesTable(family nftables.TableFamily, ta
 	return tableCache
 }
 
-func (cache *NftablesCache) SetAddElements(tableCache *NftableCache, set *nftables.Set, elements []nftables.SetElement) error {
-	err := cache.NftableConnection.SetAddElements(set, elements)
-	if err != nil {
-		cache.HasNftableConnectionError = true
-	}
+// SetAddElements queues the elements of element_text into set until Commit
+func (cache *NftablesCache) SetAddElements(tableCache *NftableCache, set *nftables.Set, elements []nftables.SetElement, element_text string) error {
+	cache.queueOperation(&NftablesOperation{Set: set, Elements: elements, Text: element_text})
+	return nil
+}
 
-	return err
+// SetDeleteElements queues the deletion of elements of element_text from set until Commit
+func (cache *NftablesCache) SetDeleteElements(tableCache *NftableCache, set *nftables.Set, elements []nftables.SetElement, element_text string) error {
+	cache.queueOperation(&NftablesOperation{Set: set, Elements: elements, Text: element_text, Delete: true})
+	return nil
 }
 
 func (cache *NftablesCache) GetFamilyName(family nftables.TableFamily) string {
@@ -271,33 +353,18 @@ func (cache *NftablesCache) GetFamilyName(family nftables.TableFamily) string {
 	return "unknown"
 }
 
-// openSystemNFTConn returns a netlink connection that tests against
-// the running kernel in a separate network namespace.
-// cleanupSystemNFTConn() must be called from a defer to cleanup
-// created network namespace.
-func openSystemNFTConn() (*nftables.Conn, netns.NsHandle, error) {
-	// We lock the goroutine into the current thread, as namespace operations
-	// such as those invoked by `netns.New()` are thread-local. This is undone
-	// in cleanupSystemNFTConn().
-	// runtime.LockOSThread()
-
-	// ns, err := netns.New()
-	// if err != nil {
-	// 	log.Errorf("netns.New() failed: %v", err)
-	// 	return nil, 0, err
-	// }
-	// c, err := nftables.New(nftables.WithNetNSFd(int(ns)))
-	c, err := nftables.New()
+// openSystemNFTConn returns a netlink connection in the current network namespace,
+// connections of other namespaces are opened by openSystemNFTBackendOfNetns.
+func openSystemNFTConn() (*netlinkBackend, netns.NsHandle, error) {
+	c, err := newNetlinkBackend()
 	if err != nil {
 		log.Errorf("Nftables call nftables.New() failed: %v", err)
 	}
-	// return c, ns, err
 	return c, 0, err
 }
 
+// cleanupSystemNFTConn closes the namespace handle of a connection
 func cleanupSystemNFTConn(newNS netns.NsHandle) {
-	// defer runtime.UnlockOSThread()
-
 	if newNS == 0 {
 		return
 	}
@@ -310,6 +377,10 @@ func SetConnectionTimeout(timeout time.Duration) {
 	cacheExpiredDuration = timeout
 }
 
+func SetSetHandleTTL(ttl time.Duration) {
+	setHandleTTL = ttl
+}
+
 func SetSetLruTimeout(timeout time.Duration) {
 	setLruTimeout = timeout
 }
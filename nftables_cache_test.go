@@ -0,0 +1,134 @@
+package coredns_nftables
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+	"github.com/vishvananda/netns"
+)
+
+// countingBackend counts the lookups of sets and the batches which modify sets
+type countingBackend struct {
+	NftablesBackend
+	lookups *atomic.Int64
+	batches *atomic.Int64
+	dirty   bool
+}
+
+func (c *countingBackend) GetSetByName(t *nftables.Table, name string) (*nftables.Set, error) {
+	c.lookups.Add(1)
+	return c.NftablesBackend.GetSetByName(t, name)
+}
+
+func (c *countingBackend) AddSet(s *nftables.Set, vals []nftables.SetElement) error {
+	c.dirty = true
+	return c.NftablesBackend.AddSet(s, vals)
+}
+
+func (c *countingBackend) SetAddElements(s *nftables.Set, vals []nftables.SetElement) error {
+	c.dirty = true
+	return c.NftablesBackend.SetAddElements(s, vals)
+}
+
+func (c *countingBackend) Discard() error {
+	c.dirty = false
+	return discardBatch(c.NftablesBackend)
+}
+
+func (c *countingBackend) Flush() error {
+	if c.dirty && c.batches != nil {
+		c.batches.Add(1)
+	}
+	c.dirty = false
+	return c.NftablesBackend.Flush()
+}
+
+func countingFactory(ruleset *NftablesMemoryRuleset, lookups *atomic.Int64, batches *atomic.Int64) NftablesBackendFactory {
+	return func() (NftablesBackend, netns.NsHandle, error) {
+		return &countingBackend{NftablesBackend: ruleset.Open(), lookups: lookups, batches: batches}, 0, nil
+	}
+}
+
+// newCountingTestHandler parses config into a handler whose backend counts the lookups of sets and the batches
+func newCountingTestHandler(t testing.TB, config string) (*NftablesHandler, *NftablesMemoryRuleset, *atomic.Int64, *atomic.Int64) {
+	ruleset := withMemoryBackend(t)
+	lookups := &atomic.Int64{}
+	batches := &atomic.Int64{}
+	SetNftablesBackendFactory(countingFactory(ruleset, lookups, batches))
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", config)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	return &handle, ruleset, lookups, batches
+}
+
+const setHandleTestConfig = `nftables ip {
+	set add element fw proxy ip false
+	set add element fw direct ip false
+}`
+
+func serveAddress(handle *NftablesHandler, ip net.IP) error {
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: ip})
+	_, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1")))
+	return err
+}
+
+func TestSetHandleCache(t *testing.T) {
+	handle, ruleset, lookups, _ := newCountingTestHandler(t, setHandleTestConfig)
+	SetSetHandleTTL(5 * time.Second)
+	defer func() {
+		SetSetHandleTTL(0)
+		SetNftablesMonitor(false, false)
+		monitorSubscribed.Store(false)
+	}()
+
+	// The first answer creates sets, and the second one caches them
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"} {
+		if err := serveAddress(handle, net.ParseIP(ip)); err != nil {
+			t.Fatalf("Expected no errors, but got: %v", err)
+		}
+		if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP(ip)) || !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "direct", net.ParseIP(ip)) {
+			t.Fatalf("Expected %v added into both sets", ip)
+		}
+	}
+	if lookups.Load() != 4 {
+		t.Fatalf("Expected 4 lookups of sets, but got: %v", lookups.Load())
+	}
+
+	SetSetHandleTTL(0)
+	lookups.Store(0)
+	if err := serveAddress(handle, net.ParseIP("192.0.2.5")); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if lookups.Load() != 2 {
+		t.Fatalf("Expected 2 lookups of sets without cache, but got: %v", lookups.Load())
+	}
+
+	// The monitor only keeps handles while it's subscribed, otherwise they expire by the TTL
+	SetSetHandleTTL(time.Nanosecond)
+	SetNftablesMonitor(true, false)
+	for i, subscribed := range []bool{false, false, true, true} {
+		if subscribed && !monitorSubscribed.Load() {
+			// Like runNftablesMonitor, handles loaded before the subscription are invalidated
+			monitorGeneration.Add(1)
+		}
+		monitorSubscribed.Store(subscribed)
+		lookups.Store(0)
+		if err := serveAddress(handle, net.IPv4(192, 0, 2, byte(10+i))); err != nil {
+			t.Fatalf("Expected no errors, but got: %v", err)
+		}
+		if expected := map[bool]int64{false: 2, true: 0}[subscribed && i == 3]; lookups.Load() != expected {
+			t.Fatalf("Expected %v lookups of sets when subscribed is %v, but got: %v", expected, subscribed, lookups.Load())
+		}
+	}
+}
@@ -0,0 +1,562 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netns"
+)
+
+var nftCliBinary string = "nft"
+var nftCliFlushInterval time.Duration = 0
+var nftCliTimeout time.Duration = time.Second * time.Duration(10)
+var nftCliRunner func(binary string, args []string, stdin []byte) ([]byte, error) = runNftCli
+var nftCliBatch = &nftCliBatcher{}
+
+// Error messages of nft which are converted into the errors of netlink
+var nftCliErrors = []struct {
+	message string
+	errno   syscall.Errno
+}{
+	{"No such file or directory", syscall.ENOENT},
+	{"File exists", syscall.EEXIST},
+	{"interval overlaps", syscall.EEXIST},
+	{"conflicting intervals", syscall.EEXIST},
+	{"Invalid argument", syscall.EINVAL},
+	{"Operation not permitted", syscall.EPERM},
+	{"Permission denied", syscall.EACCES},
+	{"Device or resource busy", syscall.EBUSY},
+	{"Operation not supported", syscall.EOPNOTSUPP},
+}
+
+// Key types of nft JSON, other types are kept by name
+var nftCliKeyTypes = map[string]nftables.SetDatatype{
+	nftables.TypeIPAddr.Name:      nftables.TypeIPAddr,
+	nftables.TypeIP6Addr.Name:     nftables.TypeIP6Addr,
+	nftables.TypeEtherAddr.Name:   nftables.TypeEtherAddr,
+	nftables.TypeInetService.Name: nftables.TypeInetService,
+	nftables.TypeInetProto.Name:   nftables.TypeInetProto,
+	nftables.TypeMark.Name:        nftables.TypeMark,
+	nftables.TypeIFName.Name:      nftables.TypeIFName,
+}
+
+// runNftCli runs nft, and converts its error messages into errors with errno.
+// nft is killed after nftCliTimeout, and the timeout is a failure of the connection instead of the operations.
+func runNftCli(binary string, args []string, stdin []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), nftCliTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.WaitDelay = time.Second
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("nft %v timeout after %v: %w", strings.Join(args, " "), nftCliTimeout, ctx.Err())
+		}
+		return nil, parseNftCliError(stderr.Bytes(), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// parseNftCliError returns the first error message of nft, which wraps the errno of the message
+func parseNftCliError(stderr []byte, err error) error {
+	message := strings.TrimSpace(string(stderr))
+	for _, line := range strings.Split(message, "\n") {
+		if strings.HasPrefix(line, "Error:") {
+			message = strings.TrimSpace(strings.TrimPrefix(line, "Error:"))
+			break
+		}
+	}
+	if message == "" {
+		return fmt.Errorf("nft failed: %w", err)
+	}
+
+	for _, known := range nftCliErrors {
+		if strings.Contains(message, known.message) {
+			return fmt.Errorf("nft: %v: %w", message, known.errno)
+		}
+	}
+	return fmt.Errorf("nft: %v: %w", message, err)
+}
+
+func nftCliFamily(family nftables.TableFamily) string {
+	switch family {
+	case nftables.TableFamilyIPv4:
+		return "ip"
+	case nftables.TableFamilyIPv6:
+		return "ip6"
+	case nftables.TableFamilyINet:
+		return "inet"
+	case nftables.TableFamilyARP:
+		return "arp"
+	case nftables.TableFamilyBridge:
+		return "bridge"
+	case nftables.TableFamilyNetdev:
+		return "netdev"
+	}
+	return "unspecified"
+}
+
+func parseNftCliFamily(family string) nftables.TableFamily {
+	for _, value := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6, nftables.TableFamilyINet,
+		nftables.TableFamilyARP, nftables.TableFamilyBridge, nftables.TableFamilyNetdev} {
+		if nftCliFamily(value) == family {
+			return value
+		}
+	}
+	return nftables.TableFamilyUnspecified
+}
+
+type nftCliTable struct {
+	Family string `json:"family"`
+	Name   string `json:"name"`
+}
+
+type nftCliSet struct {
+	Family  string            `json:"family"`
+	Table   string            `json:"table"`
+	Name    string            `json:"name"`
+	Type    json.RawMessage   `json:"type,omitempty"`
+	Flags   json.RawMessage   `json:"flags,omitempty"`
+	Timeout uint64            `json:"timeout,omitempty"`
+	Size    uint32            `json:"size,omitempty"`
+	Comment string            `json:"comment,omitempty"`
+	Elem    []json.RawMessage `json:"elem,omitempty"`
+}
+
+type nftCliElement struct {
+	Family string        `json:"family"`
+	Table  string        `json:"table"`
+	Name   string        `json:"name"`
+	Elem   []interface{} `json:"elem"`
+}
+
+type nftCliObject struct {
+	Table *nftCliTable `json:"table,omitempty"`
+	Set   *nftCliSet   `json:"set,omitempty"`
+}
+
+// nftCliConn queues modifications as nft JSON commands until Flush like *nftables.Conn
+type nftCliConn struct {
+	commands []interface{}
+}
+
+func openNftCliBackend() (NftablesBackend, netns.NsHandle, error) {
+	return &nftCliConn{}, 0, nil
+}
+
+func (c *nftCliConn) list(args ...string) ([]nftCliObject, error) {
+	stdout, err := nftCliRunner(nftCliBinary, append([]string{"-j"}, args...), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var output struct {
+		Nftables []nftCliObject `json:"nftables"`
+	}
+	if err := json.Unmarshal(stdout, &output); err != nil {
+		return nil, fmt.Errorf("nft output invalid, %v", err)
+	}
+	return output.Nftables, nil
+}
+
+func (c *nftCliConn) ListTablesOfFamily(family nftables.TableFamily) ([]*nftables.Table, error) {
+	objects, err := c.list("list", "tables", nftCliFamily(family))
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*nftables.Table
+	for _, object := range objects {
+		if object.Table != nil {
+			ret = append(ret, &nftables.Table{Family: parseNftCliFamily(object.Table.Family), Name: object.Table.Name})
+		}
+	}
+	return ret, nil
+}
+
+func (c *nftCliConn) AddTable(t *nftables.Table) *nftables.Table {
+	c.commands = append(c.commands, map[string]interface{}{
+		"add": nftCliObject{Table: &nftCliTable{Family: nftCliFamily(t.Family), Name: t.Name}},
+	})
+	return t
+}
+
+func (c *nftCliConn) getSet(t *nftables.Table, name string, terse bool) (*nftCliSet, error) {
+	args := []string{"list", "set", nftCliFamily(t.Family), t.Name, name}
+	if terse {
+		args = append([]string{"-t"}, args...)
+	}
+	objects, err := c.list(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, object := range objects {
+		if object.Set != nil {
+			return object.Set, nil
+		}
+	}
+	return nil, fmt.Errorf("set %v %v not found: %w", t.Name, name, syscall.ENOENT)
+}
+
+func (c *nftCliConn) GetSetByName(t *nftables.Table, name string) (*nftables.Set, error) {
+	output, err := c.getSet(t, name, true)
+	if err != nil {
+		return nil, err
+	}
+
+	set := &nftables.Set{Table: t, Name: output.Name, HasTimeout: output.Timeout > 0, Timeout: time.Duration(output.Timeout) * time.Second}
+	var keyTypes []string
+	if err := json.Unmarshal(output.Type, &keyTypes); err != nil {
+		var keyType string
+		json.Unmarshal(output.Type, &keyType)
+		keyTypes = []string{keyType}
+	}
+	var types []nftables.SetDatatype
+	for _, name := range keyTypes {
+		if keyType, ok := nftCliKeyTypes[name]; ok {
+			types = append(types, keyType)
+		} else {
+			types = append(types, nftables.SetDatatype{Name: name})
+		}
+	}
+	if len(types) == 1 {
+		set.KeyType = types[0]
+	} else {
+		set.Concatenation = true
+		set.KeyType = nftables.SetDatatype{Name: strings.Join(keyTypes, " . ")}
+	}
+
+	var flags []string
+	if err := json.Unmarshal(output.Flags, &flags); err != nil {
+		var flag string
+		json.Unmarshal(output.Flags, &flag)
+		flags = []string{flag}
+	}
+	for _, flag := range flags {
+		switch flag {
+		case "interval":
+			set.Interval = true
+		case "timeout":
+			set.HasTimeout = true
+		case "constant":
+			set.Constant = true
+		case "dynamic":
+			set.Dynamic = true
+		}
+	}
+	return set, nil
+}
+
+func (c *nftCliConn) AddSet(s *nftables.Set, vals []nftables.SetElement) error {
+	output := &nftCliSet{Family: nftCliFamily(s.Table.Family), Table: s.Table.Name, Name: s.Name, Size: s.Size, Comment: s.Comment}
+	if s.Concatenation {
+		output.Type, _ = json.Marshal(strings.Split(s.KeyType.Name, " . "))
+	} else {
+		output.Type, _ = json.Marshal(s.KeyType.Name)
+	}
+	var flags []string
+	if s.Constant {
+		flags = append(flags, "constant")
+	}
+	if s.Dynamic {
+		flags = append(flags, "dynamic")
+	}
+	if s.Interval {
+		flags = append(flags, "interval")
+	}
+	if s.HasTimeout {
+		flags = append(flags, "timeout")
+		output.Timeout = uint64(s.Timeout / time.Second)
+	}
+	if len(flags) > 0 {
+		output.Flags, _ = json.Marshal(flags)
+	}
+	c.commands = append(c.commands, map[string]interface{}{"add": nftCliObject{Set: output}})
+
+	if len(vals) == 0 {
+		return nil
+	}
+	return c.SetAddElements(s, vals)
+}
+
+func (c *nftCliConn) SetAddElements(s *nftables.Set, vals []nftables.SetElement) error {
+	return c.queueElements("add", s, vals)
+}
+
+func (c *nftCliConn) SetDeleteElements(s *nftables.Set, vals []nftables.SetElement) error {
+	return c.queueElements("delete", s, vals)
+}
+
+func (c *nftCliConn) queueElements(action string, s *nftables.Set, vals []nftables.SetElement) error {
+	elements, err := newNftCliElements(s, vals)
+	if err != nil {
+		return err
+	}
+	c.commands = append(c.commands, map[string]interface{}{
+		action: map[string]interface{}{
+			"element": nftCliElement{Family: nftCliFamily(s.Table.Family), Table: s.Table.Name, Name: s.Name, Elem: elements},
+		},
+	})
+	return nil
+}
+
+func (c *nftCliConn) GetSetElements(s *nftables.Set) ([]nftables.SetElement, error) {
+	output, err := c.getSet(s.Table, s.Name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []nftables.SetElement
+	for _, raw := range output.Elem {
+		elements, err := parseNftCliElement(raw, s.Interval)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, elements...)
+	}
+	return ret, nil
+}
+
+// Discard drops the queued commands
+func (c *nftCliConn) Discard() error {
+	c.commands = nil
+	return nil
+}
+
+// Flush runs the queued commands by nft, which are batched with other connections in nftCliFlushInterval
+func (c *nftCliConn) Flush() error {
+	commands := c.commands
+	c.commands = nil
+	if len(commands) == 0 {
+		return nil
+	}
+	if nftCliFlushInterval <= 0 {
+		return runNftCliCommands(commands)
+	}
+	return nftCliBatch.submit(commands)
+}
+
+// FlushNow runs the queued commands by nft without waiting for the batch of nftCliFlushInterval
+func (c *nftCliConn) FlushNow() error {
+	commands := c.commands
+	c.commands = nil
+	if len(commands) == 0 {
+		return nil
+	}
+	return runNftCliCommands(commands)
+}
+
+func runNftCliCommands(commands []interface{}) error {
+	stdin, err := json.Marshal(map[string]interface{}{"nftables": commands})
+	if err != nil {
+		return err
+	}
+	_, err = nftCliRunner(nftCliBinary, []string{"-j", "-f", "-"}, stdin)
+	return err
+}
+
+type nftCliBatchRequest struct {
+	commands []interface{}
+	done     chan error
+}
+
+// nftCliBatcher merges commands of all connections into one nft invocation
+type nftCliBatcher struct {
+	lock    sync.Mutex
+	pending []*nftCliBatchRequest
+}
+
+func (b *nftCliBatcher) submit(commands []interface{}) error {
+	request := &nftCliBatchRequest{commands: commands, done: make(chan error, 1)}
+	b.lock.Lock()
+	b.pending = append(b.pending, request)
+	if len(b.pending) == 1 {
+		time.AfterFunc(nftCliFlushInterval, b.run)
+	}
+	b.lock.Unlock()
+
+	return <-request.done
+}
+
+// run commits the pending commands in one batch. The batch is atomic, so when it fails, the commands of
+// every connection are committed separately to report their own errors.
+func (b *nftCliBatcher) run() {
+	b.lock.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.lock.Unlock()
+
+	var commands []interface{}
+	for _, request := range pending {
+		commands = append(commands, request.commands...)
+	}
+	err := runNftCliCommands(commands)
+	if err == nil || len(pending) == 1 {
+		for _, request := range pending {
+			request.done <- err
+		}
+		return
+	}
+
+	log.Debugf("Nftables nft batch of %v connections failed, commit them separately. %v", len(pending), err)
+	for _, request := range pending {
+		request.done <- runNftCliCommands(request.commands)
+	}
+}
+
+// newNftCliElements converts elements into nft JSON, intervals end with the next IntervalEnd element or KeyEnd
+func newNftCliElements(s *nftables.Set, vals []nftables.SetElement) ([]interface{}, error) {
+	var ret []interface{}
+	for i := 0; i < len(vals); i++ {
+		if vals[i].IntervalEnd {
+			continue
+		}
+		if len(vals[i].Key) != net.IPv4len && len(vals[i].Key) != net.IPv6len {
+			return nil, fmt.Errorf("element of set %v with key type %v is not supported: %w", s.Name, s.KeyType.Name, syscall.EINVAL)
+		}
+
+		var value interface{} = net.IP(vals[i].Key).String()
+		if s.Interval {
+			var last []byte
+			if len(vals[i].KeyEnd) > 0 {
+				last = vals[i].KeyEnd
+			} else if i+1 < len(vals) && vals[i+1].IntervalEnd {
+				last = previousAddress(vals[i+1].Key)
+			} else {
+				last = bytes.Repeat([]byte{0xff}, len(vals[i].Key))
+			}
+			value = newNftCliInterval(vals[i].Key, last)
+		}
+
+		timeout := uint64(math.Ceil(vals[i].Timeout.Seconds()))
+		if timeout > 0 || vals[i].Comment != "" {
+			elem := map[string]interface{}{"val": value}
+			if timeout > 0 {
+				elem["timeout"] = timeout
+			}
+			if vals[i].Comment != "" {
+				elem["comment"] = vals[i].Comment
+			}
+			value = map[string]interface{}{"elem": elem}
+		}
+		ret = append(ret, value)
+	}
+	return ret, nil
+}
+
+// newNftCliInterval returns a prefix if the inclusive interval is a network, or a range
+func newNftCliInterval(first []byte, last []byte) interface{} {
+	for ones := 0; ones <= len(first)*8; ones++ {
+		mask := net.CIDRMask(ones, len(first)*8)
+		network := net.IP(first).Mask(mask)
+		if !network.Equal(net.IP(first)) {
+			continue
+		}
+		broadcast := make(net.IP, len(first))
+		for i := range broadcast {
+			broadcast[i] = first[i] | ^mask[i]
+		}
+		if broadcast.Equal(net.IP(last)) {
+			if ones == len(first)*8 {
+				return net.IP(first).String()
+			}
+			return map[string]interface{}{"prefix": map[string]interface{}{"addr": net.IP(first).String(), "len": ones}}
+		}
+	}
+	return map[string]interface{}{"range": []string{net.IP(first).String(), net.IP(last).String()}}
+}
+
+// parseNftCliElement converts an element of nft JSON into elements, an interval is converted into start and end elements
+func parseNftCliElement(raw json.RawMessage, interval bool) ([]nftables.SetElement, error) {
+	var value struct {
+		Elem *struct {
+			Val     json.RawMessage `json:"val"`
+			Expires uint64          `json:"expires"`
+			Comment string          `json:"comment"`
+		} `json:"elem"`
+		Prefix *struct {
+			Addr string `json:"addr"`
+			Len  int    `json:"len"`
+		} `json:"prefix"`
+		Range []string `json:"range"`
+	}
+
+	var address string
+	if err := json.Unmarshal(raw, &address); err == nil {
+		return newNftCliParsedElements(address, address, interval)
+	}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("nft element %s invalid, %v", string(raw), err)
+	}
+
+	switch {
+	case value.Elem != nil:
+		ret, err := parseNftCliElement(value.Elem.Val, interval)
+		if err == nil && len(ret) > 0 {
+			ret[0].Expires = time.Duration(value.Elem.Expires) * time.Second
+			ret[0].Comment = value.Elem.Comment
+		}
+		return ret, err
+	case value.Prefix != nil:
+		_, network, err := net.ParseCIDR(fmt.Sprintf("%v/%v", value.Prefix.Addr, value.Prefix.Len))
+		if err != nil {
+			return nil, fmt.Errorf("nft element %s invalid, %v", string(raw), err)
+		}
+		return newIntervalElements(network), nil
+	case len(value.Range) == 2:
+		return newNftCliParsedElements(value.Range[0], value.Range[1], interval)
+	}
+	return nil, fmt.Errorf("nft element %s is not supported", string(raw))
+}
+
+func newNftCliParsedElements(first string, last string, interval bool) ([]nftables.SetElement, error) {
+	firstIP, lastIP := net.ParseIP(first), net.ParseIP(last)
+	if firstIP == nil || lastIP == nil {
+		return nil, fmt.Errorf("nft element %v-%v is not an address", first, last)
+	}
+	if ipv4 := firstIP.To4(); ipv4 != nil {
+		firstIP, lastIP = ipv4, lastIP.To4()
+	}
+	if !interval {
+		return []nftables.SetElement{{Key: firstIP}}, nil
+	}
+	if end := nextAddress(lastIP); end != nil {
+		return []nftables.SetElement{{Key: firstIP}, {Key: end, IntervalEnd: true}}, nil
+	}
+	return []nftables.SetElement{{Key: firstIP}}, nil
+}
+
+// previousAddress returns the address before key, the address before zero is zero
+func previousAddress(key []byte) []byte {
+	ret := make([]byte, len(key))
+	copy(ret, key)
+	for i := len(ret) - 1; i >= 0; i-- {
+		ret[i] -= 1
+		if ret[i] != 0xff {
+			return ret
+		}
+	}
+	return make([]byte, len(key))
+}
+
+// SetNftCliBackend uses nft at binary instead of netlink for new caches, commands of all connections
+// are merged into one nft invocation in flushInterval, a zero flushInterval runs nft for every connection.
+func SetNftCliBackend(binary string, flushInterval time.Duration) {
+	nftCliBinary = binary
+	nftCliFlushInterval = flushInterval
+	SetNftablesBackendFactory(openNftCliBackend)
+}
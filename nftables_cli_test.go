@@ -0,0 +1,158 @@
+package coredns_nftables
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+)
+
+func TestNftCliServeWorker(t *testing.T) {
+	var lock sync.Mutex
+	var batches []string
+	nftCliRunner = func(binary string, args []string, stdin []byte) ([]byte, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if binary != "/usr/sbin/nft" {
+			t.Errorf("Unexpected nft binary %v", binary)
+		}
+
+		switch strings.Join(args, " ") {
+		case "-j list tables ip":
+			return []byte(`{"nftables": [{"metainfo": {"json_schema_version": 1}}, {"table": {"family": "ip", "name": "fw", "handle": 1}}]}`), nil
+		case "-j -t list set ip fw proxy":
+			return nil, parseNftCliError([]byte("Error: No such file or directory\nlist set ip fw proxy\n"), errors.New("exit status 1"))
+		case "-j -t list set ip fw direct":
+			return []byte(`{"nftables": [{"set": {"family": "ip", "name": "direct", "table": "fw", "type": "ipv4_addr", "flags": ["interval"]}}]}`), nil
+		case "-j -f -":
+			batches = append(batches, string(stdin))
+			if strings.Contains(string(stdin), "10.1.0.0") {
+				return nil, parseNftCliError([]byte("Error: Could not process rule: File exists\n"), errors.New("exit status 1"))
+			}
+			return nil, nil
+		}
+		t.Errorf("Unexpected nft arguments %v", args)
+		return nil, errors.New("unexpected arguments")
+	}
+	defer func() {
+		nftCliRunner = runNftCli
+		SetNftablesBackendFactory(nil)
+		ClearCache()
+	}()
+
+	c := caddy.NewTestController("dns", `nftables ip {
+		backend nft /usr/sbin/nft
+		set add element fw proxy ip false 1h comment coredns
+	}`)
+	handle := NewNftablesHandler()
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	ClearCache()
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")})
+	if _, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1"))); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if len(batches) != 1 {
+		t.Fatalf("Expected one batch, but got: %v", batches)
+	}
+	var batch struct {
+		Nftables []map[string]map[string]json.RawMessage `json:"nftables"`
+	}
+	if err := json.Unmarshal([]byte(batches[0]), &batch); err != nil || len(batch.Nftables) != 2 ||
+		!strings.Contains(string(batch.Nftables[0]["add"]["set"]), `"flags":["timeout"],"timeout":3600`) ||
+		!strings.Contains(string(batch.Nftables[1]["add"]["element"]), `"elem":[{"elem":{"comment":"coredns","val":"192.0.2.1"}}]`) {
+		t.Fatalf("Unexpected batch %v, %v", batches[0], err)
+	}
+
+	// Commands of connections are merged, and committed separately when the batch fails
+	SetNftCliBackend("/usr/sbin/nft", 50*time.Millisecond)
+	batches = nil
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"}
+	var errs [2]error
+	var wg sync.WaitGroup
+	for i, cidr := range []string{"10.0.0.0/16", "10.1.0.0/16"} {
+		wg.Add(1)
+		go func(i int, cidr string) {
+			defer wg.Done()
+			conn, _, _ := openNftCliBackend()
+			set, err := conn.GetSetByName(table, "direct")
+			if err != nil || !set.Interval || set.KeyType != nftables.TypeIPAddr {
+				t.Errorf("Unexpected set %v, %v", set, err)
+				return
+			}
+			_, network, _ := net.ParseCIDR(cidr)
+			conn.SetAddElements(set, newIntervalElements(network))
+			errs[i] = conn.Flush()
+		}(i, cidr)
+	}
+	wg.Wait()
+	if len(batches) != 3 || errs[0] != nil || !errors.Is(errs[1], syscall.EEXIST) {
+		t.Fatalf("Unexpected batches %v, %v", batches, errs)
+	}
+	if !strings.Contains(batches[1]+batches[2], `{"prefix":{"addr":"10.0.0.0","len":16}}`) {
+		t.Fatalf("Unexpected intervals %v", batches)
+	}
+
+	// Operations replayed one by one don't wait for the flush interval
+	SetNftCliBackend("/usr/sbin/nft", time.Hour)
+	defer SetNftCliBackend("/usr/sbin/nft", 0)
+	batches = nil
+	conn, _, _ := openNftCliBackend()
+	set, _ := conn.GetSetByName(table, "direct")
+	_, network, _ := net.ParseCIDR("10.2.0.0/16")
+	conn.SetAddElements(set, newIntervalElements(network))
+	if err := flushNow(conn); err != nil || len(batches) != 1 {
+		t.Fatalf("Unexpected batches %v, %v", batches, err)
+	}
+}
+
+func TestNftCliElements(t *testing.T) {
+	elements, err := parseNftCliElement(json.RawMessage(`{"elem": {"val": {"range": ["192.0.2.0", "192.0.2.9"]}, "expires": 30}}`), true)
+	if err != nil || len(elements) != 2 || !net.IP(elements[1].Key).Equal(net.ParseIP("192.0.2.10")) ||
+		!elements[1].IntervalEnd || elements[0].Expires != 30*time.Second {
+		t.Fatalf("Unexpected elements %v, %v", elements, err)
+	}
+
+	set := &nftables.Set{Name: "direct", KeyType: nftables.TypeIPAddr, Interval: true}
+	values, err := newNftCliElements(set, elements)
+	if err != nil || len(values) != 1 {
+		t.Fatalf("Unexpected values %v, %v", values, err)
+	}
+	if output, _ := json.Marshal(values[0]); string(output) != `{"range":["192.0.2.0","192.0.2.9"]}` {
+		t.Fatalf("Unexpected value %s", output)
+	}
+}
+
+func TestNftCliTimeout(t *testing.T) {
+	binary := filepath.Join(t.TempDir(), "nft")
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\nexec sleep 10\n"), 0700); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	nftCliTimeout = 100 * time.Millisecond
+	defer func() { nftCliTimeout = 10 * time.Second }()
+
+	// A hung nft is killed, and the timeout fails the connection
+	start := time.Now()
+	_, err := runNftCli(binary, []string{"-j", "list", "tables"}, nil)
+	if !errors.Is(err, context.DeadlineExceeded) || isNftablesOperationError(err) {
+		t.Fatalf("Expected timeout errors, but got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Expected nft killed after the timeout, but it costs %v", elapsed)
+	}
+}
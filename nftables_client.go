@@ -0,0 +1,153 @@
+package coredns_nftables
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// hostNetwork returns the network of a single address
+func hostNetwork(ip net.IP) *net.IPNet {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return &net.IPNet{IP: ipv4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+}
+
+func isHostNetwork(network *net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	return ones == bits
+}
+
+// clientNetwork returns the network of the querying client.
+// It's the source prefix of EDNS Client Subnet when the request comes from a trusted forwarder,
+// or the socket address otherwise.
+func (m *NftablesHandler) clientNetwork(state *request.Request) *net.IPNet {
+	ip := net.ParseIP(state.IP())
+	if ip == nil {
+		return nil
+	}
+	client := hostNetwork(ip)
+
+	if len(m.EcsTrustedForwarders) == 0 {
+		return client
+	}
+	trusted := false
+	for _, forwarder := range m.EcsTrustedForwarders {
+		if forwarder.Contains(ip) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return client
+	}
+
+	opt := state.Req.IsEdns0()
+	if opt == nil {
+		return client
+	}
+	for _, option := range opt.Option {
+		subnet, ok := option.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+
+		network, err := ecsNetwork(subnet)
+		if err != nil {
+			log.Debugf("Ignore EDNS Client Subnet %v from %v, %v", subnet.String(), ip.String(), err)
+			return client
+		}
+		return network
+	}
+
+	return client
+}
+
+// ecsNetwork validates and returns the source prefix of a EDNS Client Subnet option
+func ecsNetwork(subnet *dns.EDNS0_SUBNET) (*net.IPNet, error) {
+	var bits int
+	var address net.IP
+	switch subnet.Family {
+	case 1:
+		bits = 32
+		address = subnet.Address.To4()
+	case 2:
+		bits = 128
+		if subnet.Address.To4() == nil {
+			address = subnet.Address.To16()
+		}
+	default:
+		return nil, fmt.Errorf("unknown family %v", subnet.Family)
+	}
+	if address == nil {
+		return nil, fmt.Errorf("address %v mismatch family %v", subnet.Address, subnet.Family)
+	}
+	if subnet.SourceNetmask == 0 || int(subnet.SourceNetmask) > bits {
+		return nil, fmt.Errorf("source prefix length %v invalid", subnet.SourceNetmask)
+	}
+
+	mask := net.CIDRMask(int(subnet.SourceNetmask), bits)
+	return &net.IPNet{IP: address.Mask(mask), Mask: mask}, nil
+}
+
+func (m *NftablesHandler) hasClientRule() bool {
+	for _, ruleSet := range m.Rules {
+		if len(ruleSet.RuleAddClient) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// serveClient adds the address of the querying client into the sets of client rules.
+// A client network which is not a single address is only added into interval sets.
+func (m *NftablesHandler) serveClient(ctx context.Context, cache *NftablesCache, query *NftablesQuery) int {
+	client := query.Client
+	if client == nil {
+		return 0
+	}
+	if m.isExcludedAddress(client.IP) {
+		log.Debugf("Ignore client %v(%v) because it's excluded", client.String(), query.Name)
+		return 0
+	}
+
+	tableFamilies := ipv4TableFamilies
+	if client.IP.To4() == nil {
+		tableFamilies = ipv6TableFamilies
+	}
+
+	applyCounter := 0
+	for _, family := range tableFamilies {
+		ruleSet, ok := m.Rules[family]
+		if !ok {
+			continue
+		}
+		for _, rule := range ruleSet.RuleAddClient {
+			if !rule.Match(ctx, query) {
+				continue
+			}
+
+			var err error
+			var ignored bool
+			if isHostNetwork(client) {
+				err, ignored = rule.ServeIP(ctx, cache, client.IP, family)
+			} else if rule.Interval {
+				err, ignored = rule.ServeCIDR(ctx, cache, client, family)
+			} else {
+				log.Debugf("Nftables set %v %v %v ignore client %v because it's not a interval set", cache.GetFamilyName(family), rule.TableName, rule.SetName, client.String())
+				continue
+			}
+			if err != nil {
+				log.Errorf("Add client %v(%v) to %v %v %v failed.%v", client.String(), query.Name, cache.GetFamilyName(family), rule.TableName, rule.SetName, err)
+			} else if !ignored {
+				applyCounter += 1
+			}
+		}
+	}
+
+	return applyCounter
+}
@@ -0,0 +1,43 @@
+package coredns_nftables
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestClientNetwork(t *testing.T) {
+	handle := NewNftablesHandler()
+	handle.EcsTrustedForwarders = []*net.IPNet{hostNetwork(net.ParseIP("10.0.0.53"))}
+
+	newRequest := func(remoteIP string, subnet *dns.EDNS0_SUBNET) *request.Request {
+		r := new(dns.Msg)
+		r.SetQuestion("example.org.", dns.TypeA)
+		if subnet != nil {
+			r.SetEdns0(4096, false)
+			opt := r.IsEdns0()
+			opt.Option = append(opt.Option, subnet)
+		}
+		return &request.Request{W: &test.ResponseWriter{RemoteIP: remoteIP}, Req: r}
+	}
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.168.10.77")}
+
+	if client := handle.clientNetwork(newRequest("10.0.0.53", subnet)); client.String() != "192.168.10.0/24" {
+		t.Fatalf("Expected client 192.168.10.0/24, but got: %v", client)
+	}
+	if client := handle.clientNetwork(newRequest("10.0.0.54", subnet)); client.String() != "10.0.0.54/32" {
+		t.Fatalf("Expected client 10.0.0.54/32 from untrusted forwarder, but got: %v", client)
+	}
+	invalid := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 33, Address: net.ParseIP("192.168.10.77")}
+	if client := handle.clientNetwork(newRequest("10.0.0.53", invalid)); client.String() != "10.0.0.53/32" {
+		t.Fatalf("Expected client 10.0.0.53/32 with invalid subnet, but got: %v", client)
+	}
+
+	rule := NftablesSetAddElement{Clients: []*net.IPNet{{IP: net.ParseIP("192.168.0.0").To4(), Mask: net.CIDRMask(16, 32)}}}
+	if !rule.MatchClient(handle.clientNetwork(newRequest("10.0.0.53", subnet))) {
+		t.Fatalf("Expected client subnet matched by %v", rule.Clients)
+	}
+}
@@ -0,0 +1,174 @@
+package coredns_nftables
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// coalesceWindow is how long operations of requests are collected before they're committed, 0 disables coalescing
+var coalesceWindow time.Duration = 0
+
+// coalesceMaxElements commits the collected operations before coalesceWindow when they have so many elements
+var coalesceMaxElements int = 256
+
+func SetNftablesCoalesce(window time.Duration, maxElements int) {
+	coalesceWindow = window
+	coalesceMaxElements = maxElements
+}
+
+// coalescedOperation is an operation committed for all duplicated operations of requests
+type coalescedOperation struct {
+	op         *NftablesOperation
+	duplicates []*NftablesOperation
+}
+
+// nftablesCoalescer collects operations of all requests, and commits them in one batch
+type nftablesCoalescer struct {
+	lock       sync.Mutex
+	operations []*coalescedOperation
+	index      map[string]*coalescedOperation
+	elements   int
+	timer      *time.Timer
+	// window is the sequence of the collecting window, a timer or a flush of an older window does nothing
+	window uint64
+	// done is closed when the collected operations are committed
+	done chan struct{}
+}
+
+var coalescer = &nftablesCoalescer{}
+
+// coalesceKeys returns the key of op, and the keys of operations which conflict with it
+func coalesceKeys(op *NftablesOperation) (string, []string) {
+	keys := make([]string, 0, len(op.Elements))
+	for _, element := range op.Elements {
+		key := hex.EncodeToString(element.Key)
+		if element.IntervalEnd {
+			key += "-"
+		}
+		keys = append(keys, key)
+	}
+	base := fmt.Sprintf("%v %v %v %v", op.Set.Table.Family, op.Set.Table.Name, op.Set.Name, strings.Join(keys, ","))
+	if op.Delete {
+		return "delete " + base, []string{"add " + base, "create " + base}
+	}
+	if op.CreateSet {
+		return "create " + base, []string{"delete " + base}
+	}
+	return "add " + base, []string{"delete " + base}
+}
+
+// submit collects operations, and waits until they're committed if wait is true.
+// It returns the failed ones of operations, which is always empty without wait.
+func (c *nftablesCoalescer) submit(operations []*NftablesOperation, wait bool) []*NftablesOperation {
+	c.lock.Lock()
+	if c.done == nil {
+		c.done = make(chan struct{})
+		c.index = make(map[string]*coalescedOperation)
+		c.window += 1
+		window := c.window
+		c.timer = time.AfterFunc(coalesceWindow, func() { c.flush(window) })
+	}
+	done := c.done
+	window := c.window
+	for _, op := range operations {
+		key, conflicts := coalesceKeys(op)
+		// An operation is only merged when no later operation reverts it
+		for _, conflict := range conflicts {
+			delete(c.index, conflict)
+		}
+		if coalesced, ok := c.index[key]; ok {
+			coalesced.duplicates = append(coalesced.duplicates, op)
+			continue
+		}
+
+		op.addTable = true
+		coalesced := &coalescedOperation{op: op}
+		c.index[key] = coalesced
+		c.operations = append(c.operations, coalesced)
+		c.elements += len(op.Elements)
+	}
+	full := coalesceMaxElements > 0 && c.elements >= coalesceMaxElements
+	c.lock.Unlock()
+
+	if full {
+		c.flush(window)
+	}
+	if !wait {
+		return nil
+	}
+
+	<-done
+	var failed []*NftablesOperation
+	for _, op := range operations {
+		if op.Err != nil {
+			failed = append(failed, op)
+		}
+	}
+	return failed
+}
+
+// flush commits the collected operations of window in one batch, and wakes up the requests waiting for them
+func (c *nftablesCoalescer) flush(window uint64) {
+	c.lock.Lock()
+	if c.done == nil || c.window != window {
+		c.lock.Unlock()
+		return
+	}
+	operations := c.operations
+	done := c.done
+	elements := c.elements
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.operations = nil
+	c.index = nil
+	c.elements = 0
+	c.timer = nil
+	c.done = nil
+	c.lock.Unlock()
+	defer close(done)
+
+	cache, err := NewCache()
+	if err != nil {
+		log.Errorf("Nftables coalesce %v operation(s) failed, %v", len(operations), err)
+		for _, coalesced := range operations {
+			coalesced.op.Err = err
+			for _, duplicate := range coalesced.duplicates {
+				duplicate.Err = err
+			}
+		}
+		return
+	}
+	defer CloseCache(cache)
+
+	duplicates := 0
+	for _, coalesced := range operations {
+		cache.queueOperation(coalesced.op)
+		duplicates += len(coalesced.duplicates)
+	}
+	failed := cache.Commit()
+	for _, coalesced := range operations {
+		for _, duplicate := range coalesced.duplicates {
+			duplicate.Err = coalesced.op.Err
+		}
+	}
+	log.Debugf("Nftables coalesce %v operation(s) of %v element(s) in one batch, %v duplicated and %v failed", len(operations), elements, duplicates, len(failed))
+}
+
+// commitOperations commits the operations of cache. When coalescing is enabled, operations of the network namespace
+// of CoreDNS are committed with other requests, and requests only wait for them in sync mode.
+func commitOperations(cache *NftablesCache) []*NftablesOperation {
+	if coalesceWindow <= 0 || len(cache.operations) == 0 {
+		return cache.Commit()
+	}
+
+	operations := cache.operations
+	cache.operations = nil
+	cache.pendingSets = nil
+	failed := coalescer.submit(operations, !asyncMode)
+	// Operations of other namespaces are still committed by the connections of this request
+	return append(failed, cache.Commit()...)
+}
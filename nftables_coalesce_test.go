@@ -0,0 +1,156 @@
+package coredns_nftables
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+	"github.com/vishvananda/netns"
+)
+
+func TestCoalesceSync(t *testing.T) {
+	handle, ruleset, _, batches := newCountingTestHandler(t, `nftables ip {
+		coalesce 200ms max 100
+		set add element fw proxy ip false
+	}`)
+	defer func() {
+		SetNftablesCoalesce(0, 256)
+	}()
+
+	// Concurrent responses with the same address are committed by one batch, and wait for it
+	var wg sync.WaitGroup
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.1", "192.0.2.3"} {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			if err := serveAddress(handle, net.ParseIP(ip)); err != nil {
+				t.Errorf("Expected no errors, but got: %v", err)
+			}
+			if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP(ip)) {
+				t.Errorf("Expected %v added when the request returns", ip)
+			}
+		}(ip)
+	}
+	wg.Wait()
+	if batches.Load() != 1 {
+		t.Fatalf("Expected one batch, but got: %v", batches.Load())
+	}
+
+	// Operations are committed without waiting for the window when there are enough elements
+	SetNftablesCoalesce(time.Hour, 1)
+	if err := serveAddress(handle, net.ParseIP("192.0.2.4")); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.4")) || batches.Load() != 2 {
+		t.Fatalf("Expected element added by another batch, but got %v batches", batches.Load())
+	}
+}
+
+func TestCoalesceAsync(t *testing.T) {
+	handle, ruleset, _, _ := newCountingTestHandler(t, `nftables ip {
+		async true
+		coalesce 20ms
+		set add element fw proxy ip false
+	}`)
+	defer func() {
+		SetNftableAsyncMode(false)
+		SetNftablesCoalesce(0, 256)
+	}()
+
+	// Requests only enqueue their operations in async mode
+	if err := serveAddress(handle, net.ParseIP("192.0.2.1")); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Expected element not added before the window")
+	}
+	for i := 0; i < 100 && !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.1")); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Expected element added after the window")
+	}
+}
+
+func TestCoalesceKeepsOrder(t *testing.T) {
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"}
+	set := &nftables.Set{Table: table, Name: "proxy"}
+	elements := []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}}
+	add, _ := coalesceKeys(&NftablesOperation{Set: set, Elements: elements})
+	del, conflicts := coalesceKeys(&NftablesOperation{Set: set, Elements: elements, Delete: true})
+	if add == del || len(conflicts) != 2 || conflicts[0] != add {
+		t.Fatalf("Expected deletion conflicts with addition, but got: %v, %v, %v", add, del, conflicts)
+	}
+}
+
+func TestCoalesceStaleWindow(t *testing.T) {
+	SetNftablesCoalesce(time.Hour, 0)
+	defer SetNftablesCoalesce(0, 256)
+
+	// A timer or a full flush of the previous window doesn't commit the next one early
+	c := &nftablesCoalescer{}
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"}
+	c.submit([]*NftablesOperation{{Set: &nftables.Set{Table: table, Name: "proxy"}, Elements: []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}}}}, false)
+	c.flush(c.window - 1)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.timer.Stop()
+	if len(c.operations) != 1 || c.done == nil {
+		t.Fatalf("Expected operations of the window kept, but got: %v", c.operations)
+	}
+}
+
+func TestCoalesceSyncFailedAnswer(t *testing.T) {
+	ruleset := withMemoryBackend(t)
+	conn := ruleset.Open()
+	table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"})
+	conn.AddSet(&nftables.Set{Table: table, Name: "proxy", KeyType: nftables.TypeIPAddr}, nil)
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetNftablesBackendFactory(func() (NftablesBackend, netns.NsHandle, error) {
+		return &rejectingBackend{countingBackend: &countingBackend{NftablesBackend: ruleset.Open(), lookups: &atomic.Int64{}}, rejected: net.ParseIP("192.0.2.9")}, 0, nil
+	})
+	defer SetNftablesCoalesce(0, 256)
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		coalesce 20ms
+		set add element fw proxy ip false
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	// The failed element of a coalesced batch is still attributed to its answer, which is not cached by the LRU
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	for _, ip := range []string{"192.0.2.1", "192.0.2.9"} {
+		r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(ip)})
+	}
+	applyCounter, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1")))
+	if err != nil || applyCounter != 1 {
+		t.Fatalf("Expected 1 element applied, but got: %v, %v", applyCounter, err)
+	}
+	if !pooledLruContains("192.0.2.1") || pooledLruContains("192.0.2.9") {
+		t.Fatalf("Expected only the committed answer in the LRU")
+	}
+}
+
+// pooledLruContains returns true if the LRU of a pooled cache contains ip
+func pooledLruContains(ip string) bool {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	for e := cacheList.Front(); e != nil; e = e.Next() {
+		if e.Value.(*NftablesCache).recentlyIPCache.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,472 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// NftablesChainBackend is implemented by backends which can create chains and rules of define chain
+type NftablesChainBackend interface {
+	AddChain(c *nftables.Chain) *nftables.Chain
+	FlushChain(c *nftables.Chain)
+	AddRule(r *nftables.Rule) *nftables.Rule
+}
+
+var _ NftablesChainBackend = (*nftables.Conn)(nil)
+
+// NftablesSetDefinition is a set of define set, which is created at startup with all its attributes
+type NftablesSetDefinition struct {
+	Set   *nftables.Set
+	Netns *NftablesNetns
+}
+
+// NftablesRuleDefinition is a rule of define chain:
+// [ip/ip6 saddr/daddr [!=] @SET] [counter] [meta mark set <MARK>] [accept/drop/return/jump <CHAIN>/goto <CHAIN>]
+type NftablesRuleDefinition struct {
+	Text string
+	// Family is the address family of the set match, TableFamilyUnspecified means no match
+	Family  nftables.TableFamily
+	Field   string
+	Invert  bool
+	SetName string
+	Counter bool
+	Mark    *uint32
+	Verdict *expr.Verdict
+}
+
+// NftablesChainDefinition is a chain of define chain, whose rules are replaced at startup
+type NftablesChainDefinition struct {
+	Chain *nftables.Chain
+	Rules []*NftablesRuleDefinition
+	Netns *NftablesNetns
+}
+
+// NftablesDefinitions is the firewall layout owned by the Corefile
+type NftablesDefinitions struct {
+	Sets   []*NftablesSetDefinition
+	Chains []*NftablesChainDefinition
+}
+
+func (d *NftablesDefinitions) Empty() bool {
+	return len(d.Sets) == 0 && len(d.Chains) == 0
+}
+
+var nftablesChainHooks = map[string]*nftables.ChainHook{
+	"prerouting":  nftables.ChainHookPrerouting,
+	"input":       nftables.ChainHookInput,
+	"forward":     nftables.ChainHookForward,
+	"output":      nftables.ChainHookOutput,
+	"postrouting": nftables.ChainHookPostrouting,
+	"ingress":     nftables.ChainHookIngress,
+}
+
+var nftablesChainPriorities = map[string]*nftables.ChainPriority{
+	"raw":      nftables.ChainPriorityRaw,
+	"mangle":   nftables.ChainPriorityMangle,
+	"dstnat":   nftables.ChainPriorityNATDest,
+	"filter":   nftables.ChainPriorityFilter,
+	"security": nftables.ChainPrioritySecurity,
+	"srcnat":   nftables.ChainPriorityNATSource,
+}
+
+// splitDefineStatement splits tokens of a statement such as "interval, timeout" by sep
+func splitDefineStatement(values []string, sep string) []string {
+	var ret []string
+	for _, value := range strings.Split(strings.Join(values, " "), sep) {
+		if value = strings.TrimSpace(value); value != "" {
+			ret = append(ret, value)
+		}
+	}
+	return ret
+}
+
+// parseSetDefinition parses statements of define set <family> <table> <name>
+func parseSetDefinition(family nftables.TableFamily, tableName string, setName string, statements [][]string) (*NftablesSetDefinition, error) {
+	ret := &NftablesSetDefinition{Set: &nftables.Set{Table: &nftables.Table{Family: family, Name: tableName}, Name: setName}}
+	for _, statement := range statements {
+		keyword, values := strings.ToLower(statement[0]), statement[1:]
+		if len(values) == 0 && keyword != "counter" {
+			return nil, fmt.Errorf("%v requires a value", keyword)
+		}
+
+		switch keyword {
+		case "type":
+			var types []nftables.SetDatatype
+			for _, name := range splitDefineStatement(values, ".") {
+				keyType, ok := nftCliKeyTypes[name]
+				if !ok {
+					return nil, fmt.Errorf("type %v is not supported", name)
+				}
+				types = append(types, keyType)
+			}
+			if len(types) == 1 {
+				ret.Set.KeyType = types[0]
+			} else {
+				keyType, err := nftables.ConcatSetType(types...)
+				if err != nil {
+					return nil, err
+				}
+				ret.Set.KeyType = keyType
+				ret.Set.Concatenation = true
+			}
+		case "flags":
+			for _, flag := range splitDefineStatement(values, ",") {
+				switch flag {
+				case "constant":
+					ret.Set.Constant = true
+				case "interval":
+					ret.Set.Interval = true
+				case "timeout":
+					ret.Set.HasTimeout = true
+				case "dynamic":
+					ret.Set.Dynamic = true
+				default:
+					return nil, fmt.Errorf("flag %v is not supported", flag)
+				}
+			}
+		case "timeout":
+			duration, err := time.ParseDuration(values[0])
+			if err != nil || len(values) != 1 {
+				return nil, fmt.Errorf("timeout %v invalid", values)
+			}
+			ret.Set.HasTimeout = true
+			ret.Set.Timeout = duration
+		case "size":
+			size, err := strconv.ParseUint(values[0], 10, 32)
+			if err != nil || len(values) != 1 {
+				return nil, fmt.Errorf("size %v invalid", values)
+			}
+			ret.Set.Size = uint32(size)
+		case "policy", "gc-interval":
+			return nil, fmt.Errorf("set statement %v is not supported by the netlink library", keyword)
+		case "counter":
+			ret.Set.Counter = true
+		case "comment":
+			ret.Set.Comment = strings.Join(values, " ")
+		case "netns":
+			target, err := parseNetns(values)
+			if err != nil {
+				return nil, err
+			}
+			ret.Netns = target
+		default:
+			return nil, fmt.Errorf("statement %v is not supported", keyword)
+		}
+	}
+
+	if ret.Set.KeyType.Bytes == 0 {
+		return nil, fmt.Errorf("set %v %v requires type", tableName, setName)
+	}
+	return ret, nil
+}
+
+// parseChainDefinition parses statements of define chain <family> <table> <name>
+func parseChainDefinition(family nftables.TableFamily, tableName string, chainName string, statements [][]string) (*NftablesChainDefinition, error) {
+	ret := &NftablesChainDefinition{Chain: &nftables.Chain{Table: &nftables.Table{Family: family, Name: tableName}, Name: chainName}}
+	for _, statement := range statements {
+		keyword, values := strings.ToLower(statement[0]), statement[1:]
+		if len(values) == 0 {
+			return nil, fmt.Errorf("%v requires a value", keyword)
+		}
+
+		switch keyword {
+		case "type":
+			// type <filter/nat/route> hook <HOOK> [device <DEVICE>] priority <PRIORITY>
+			ret.Chain.Type = nftables.ChainType(strings.ToLower(values[0]))
+			if ret.Chain.Type != nftables.ChainTypeFilter && ret.Chain.Type != nftables.ChainTypeNAT && ret.Chain.Type != nftables.ChainTypeRoute {
+				return nil, fmt.Errorf("chain type %v is not supported", values[0])
+			}
+			for i := 1; i < len(values); i += 2 {
+				if i+1 >= len(values) {
+					return nil, fmt.Errorf("%v of chain type requires a value", values[i])
+				}
+				value := strings.ToLower(values[i+1])
+				switch strings.ToLower(values[i]) {
+				case "hook":
+					hook, ok := nftablesChainHooks[value]
+					if !ok {
+						return nil, fmt.Errorf("hook %v is not supported", values[i+1])
+					}
+					ret.Chain.Hooknum = hook
+				case "device":
+					ret.Chain.Device = values[i+1]
+				case "priority":
+					priority, ok := nftablesChainPriorities[value]
+					if !ok {
+						parsePriority, err := strconv.ParseInt(value, 10, 32)
+						if err != nil {
+							return nil, fmt.Errorf("priority %v invalid", values[i+1])
+						}
+						priority = nftables.ChainPriorityRef(nftables.ChainPriority(parsePriority))
+					}
+					ret.Chain.Priority = priority
+				default:
+					return nil, fmt.Errorf("%v of chain type is not supported", values[i])
+				}
+			}
+			if ret.Chain.Hooknum == nil || ret.Chain.Priority == nil {
+				return nil, fmt.Errorf("chain type %v requires hook and priority", values[0])
+			}
+		case "policy":
+			var policy nftables.ChainPolicy
+			switch strings.ToLower(values[0]) {
+			case "accept":
+				policy = nftables.ChainPolicyAccept
+			case "drop":
+				policy = nftables.ChainPolicyDrop
+			default:
+				return nil, fmt.Errorf("policy %v invalid, only accept and drop are supported", values[0])
+			}
+			ret.Chain.Policy = &policy
+		case "rule":
+			rule, err := parseRuleDefinition(family, values)
+			if err != nil {
+				return nil, err
+			}
+			ret.Rules = append(ret.Rules, rule)
+		case "netns":
+			target, err := parseNetns(values)
+			if err != nil {
+				return nil, err
+			}
+			ret.Netns = target
+		default:
+			return nil, fmt.Errorf("statement %v is not supported", keyword)
+		}
+	}
+
+	if ret.Chain.Type == "" && ret.Chain.Policy != nil {
+		return nil, fmt.Errorf("chain %v %v without type has no policy", tableName, chainName)
+	}
+	return ret, nil
+}
+
+func parseRuleDefinition(chainFamily nftables.TableFamily, values []string) (*NftablesRuleDefinition, error) {
+	ret := &NftablesRuleDefinition{Text: strings.Join(values, " ")}
+	for i := 0; i < len(values); i++ {
+		if ret.Verdict != nil {
+			return nil, fmt.Errorf("rule %v has statements after verdict", ret.Text)
+		}
+
+		switch keyword := strings.ToLower(values[i]); keyword {
+		case "ip", "ip6":
+			if ret.Family != nftables.TableFamilyUnspecified || i+2 >= len(values) {
+				return nil, fmt.Errorf("rule %v invalid, only one ip/ip6 saddr/daddr @SET is supported", ret.Text)
+			}
+			ret.Family = nftables.TableFamilyIPv4
+			if keyword == "ip6" {
+				ret.Family = nftables.TableFamilyIPv6
+			}
+			if chainFamily != ret.Family && chainFamily != nftables.TableFamilyINet {
+				return nil, fmt.Errorf("rule %v invalid, %v doesn't match family of chain", ret.Text, keyword)
+			}
+			ret.Field = strings.ToLower(values[i+1])
+			if ret.Field != "saddr" && ret.Field != "daddr" {
+				return nil, fmt.Errorf("rule %v invalid, only saddr and daddr are supported", ret.Text)
+			}
+			i += 2
+			if values[i] == "!=" && i+1 < len(values) {
+				ret.Invert = true
+				i += 1
+			}
+			if !strings.HasPrefix(values[i], "@") || len(values[i]) == 1 {
+				return nil, fmt.Errorf("rule %v invalid, %v is not a set reference", ret.Text, values[i])
+			}
+			ret.SetName = values[i][1:]
+		case "counter":
+			ret.Counter = true
+		case "meta", "mark":
+			if keyword == "meta" {
+				i += 1
+			}
+			if i+2 >= len(values) || strings.ToLower(values[i]) != "mark" || strings.ToLower(values[i+1]) != "set" {
+				return nil, fmt.Errorf("rule %v invalid, only meta mark set <MARK> is supported", ret.Text)
+			}
+			mark, err := strconv.ParseUint(values[i+2], 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("rule %v invalid, mark %v invalid", ret.Text, values[i+2])
+			}
+			value := uint32(mark)
+			ret.Mark = &value
+			i += 2
+		case "accept":
+			ret.Verdict = &expr.Verdict{Kind: expr.VerdictAccept}
+		case "drop":
+			ret.Verdict = &expr.Verdict{Kind: expr.VerdictDrop}
+		case "return":
+			ret.Verdict = &expr.Verdict{Kind: expr.VerdictReturn}
+		case "jump", "goto":
+			if i+1 >= len(values) {
+				return nil, fmt.Errorf("rule %v invalid, %v requires a chain", ret.Text, keyword)
+			}
+			ret.Verdict = &expr.Verdict{Kind: expr.VerdictJump, Chain: values[i+1]}
+			if keyword == "goto" {
+				ret.Verdict.Kind = expr.VerdictGoto
+			}
+			i += 1
+		default:
+			return nil, fmt.Errorf("rule %v invalid, %v is not supported", ret.Text, values[i])
+		}
+	}
+	return ret, nil
+}
+
+// exprs returns the expressions of the rule in a chain of chainFamily, set is the referenced set or nil
+func (rule *NftablesRuleDefinition) exprs(chainFamily nftables.TableFamily, set *nftables.Set) []expr.Any {
+	var ret []expr.Any
+	if set != nil {
+		if chainFamily == nftables.TableFamilyINet {
+			nfproto := byte(unix.NFPROTO_IPV4)
+			if rule.Family == nftables.TableFamilyIPv6 {
+				nfproto = unix.NFPROTO_IPV6
+			}
+			ret = append(ret,
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+			)
+		}
+
+		payload := &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4}
+		if rule.Family == nftables.TableFamilyIPv4 && rule.Field == "daddr" {
+			payload.Offset = 16
+		} else if rule.Family == nftables.TableFamilyIPv6 {
+			payload.Offset, payload.Len = 8, 16
+			if rule.Field == "daddr" {
+				payload.Offset = 24
+			}
+		}
+		ret = append(ret, payload, &expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID, Invert: rule.Invert})
+	}
+	if rule.Counter {
+		ret = append(ret, &expr.Counter{})
+	}
+	if rule.Mark != nil {
+		ret = append(ret,
+			&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(*rule.Mark)},
+			&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+		)
+	}
+	if rule.Verdict != nil {
+		ret = append(ret, rule.Verdict)
+	}
+	return ret
+}
+
+type nftablesDefinitionKey struct {
+	family nftables.TableFamily
+	table  string
+	name   string
+}
+
+// Provision creates the defined tables, sets and chains, and replaces the rules of the defined chains.
+// Definitions of a network namespace are committed in one batch, so the layout is never partially applied.
+func (m *NftablesHandler) Provision() error {
+	var keys []string
+	namespaces := make(map[string]*NftablesDefinitions)
+	targets := make(map[string]*NftablesNetns)
+	group := func(target *NftablesNetns) *NftablesDefinitions {
+		key := target.String()
+		if _, ok := namespaces[key]; !ok {
+			keys = append(keys, key)
+			namespaces[key] = &NftablesDefinitions{}
+			targets[key] = target
+		}
+		return namespaces[key]
+	}
+	for _, set := range m.Definitions.Sets {
+		definitions := group(set.Netns)
+		definitions.Sets = append(definitions.Sets, set)
+	}
+	for _, chain := range m.Definitions.Chains {
+		definitions := group(chain.Netns)
+		definitions.Chains = append(definitions.Chains, chain)
+	}
+
+	for _, key := range keys {
+		if err := namespaces[key].provision(targets[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *NftablesDefinitions) provision(target *NftablesNetns) error {
+	var conn NftablesBackend
+	var ns netns.NsHandle
+	var err error
+	if target == nil {
+		conn, ns, err = nftablesBackendFactory()
+	} else {
+		conn, ns, err = nftablesNetnsBackendFactory(target)
+	}
+	if err != nil {
+		return err
+	}
+	defer cleanupSystemNFTConn(ns)
+	if closer, ok := conn.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	tables := make(map[nftablesDefinitionKey]*nftables.Table)
+	mutableTable := func(t *nftables.Table) *nftables.Table {
+		key := nftablesDefinitionKey{family: t.Family, table: t.Name}
+		if table, ok := tables[key]; ok {
+			return table
+		}
+		tables[key] = conn.AddTable(&nftables.Table{Family: t.Family, Name: t.Name})
+		return tables[key]
+	}
+
+	sets := make(map[nftablesDefinitionKey]*nftables.Set)
+	for _, definition := range d.Sets {
+		set := *definition.Set
+		set.Table = mutableTable(definition.Set.Table)
+		if err := conn.AddSet(&set, nil); err != nil {
+			return fmt.Errorf("define set %v %v failed, %w", set.Table.Name, set.Name, err)
+		}
+		sets[nftablesDefinitionKey{family: set.Table.Family, table: set.Table.Name, name: set.Name}] = &set
+	}
+
+	if len(d.Chains) > 0 {
+		chainConn, ok := conn.(NftablesChainBackend)
+		if !ok {
+			return fmt.Errorf("define chain is not supported by this backend")
+		}
+
+		chains := make([]*nftables.Chain, 0, len(d.Chains))
+		for _, definition := range d.Chains {
+			chain := *definition.Chain
+			chain.Table = mutableTable(definition.Chain.Table)
+			chains = append(chains, chainConn.AddChain(&chain))
+			chainConn.FlushChain(&chain)
+		}
+		// Rules are added after all chains, so they can jump to chains defined later
+		for i, definition := range d.Chains {
+			for _, rule := range definition.Rules {
+				var set *nftables.Set
+				if rule.SetName != "" {
+					key := nftablesDefinitionKey{family: chains[i].Table.Family, table: chains[i].Table.Name, name: rule.SetName}
+					if set = sets[key]; set == nil {
+						set = &nftables.Set{Table: chains[i].Table, Name: rule.SetName}
+					}
+				}
+				chainConn.AddRule(&nftables.Rule{Table: chains[i].Table, Chain: chains[i], Exprs: rule.exprs(chains[i].Table.Family, set)})
+			}
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("define %v set(s) and %v chain(s) in netns %q failed, %w", len(d.Sets), len(d.Chains), target.String(), err)
+	}
+	log.Infof("Nftables define %v set(s) and %v chain(s) in netns %q done", len(d.Sets), len(d.Chains), target.String())
+	return nil
+}
@@ -0,0 +1,100 @@
+package coredns_nftables
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+func TestDefineProvision(t *testing.T) {
+	ruleset := withMemoryBackend(t)
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables inet {
+		define set inet fw proxy {
+			type ipv4_addr; flags interval, timeout
+			timeout 1h; size 65536
+			counter
+		}
+		define chain inet fw prerouting {
+			type filter hook prerouting priority mangle; policy accept
+			rule ip daddr @proxy counter meta mark set 0x1
+			rule jump proxy_rules
+		}
+		define chain inet fw proxy_rules {
+			rule ip saddr != @proxy return
+		}
+		set add element fw proxy ip true domain example.org
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	// Provision again replaces the rules of chains
+	for i := 0; i < 2; i++ {
+		if err := handle.Provision(); err != nil {
+			t.Fatalf("Expected no errors, but got: %v", err)
+		}
+	}
+
+	set, err := ruleset.Open().GetSetByName(&nftables.Table{Family: nftables.TableFamilyINet, Name: "fw"}, "proxy")
+	if err != nil || !set.Interval || !set.HasTimeout || set.Timeout != time.Hour || set.Size != 65536 || !set.Counter {
+		t.Fatalf("Unexpected set %v: %v", set, err)
+	}
+	rules, ok := ruleset.Rules(nftables.TableFamilyINet, "fw", "prerouting")
+	if !ok || len(rules) != 2 || len(rules[0].Exprs) != 7 {
+		t.Fatalf("Unexpected rules of prerouting %v", rules)
+	}
+	if lookup, ok := rules[0].Exprs[3].(*expr.Lookup); !ok || lookup.SetName != "proxy" || lookup.Invert {
+		t.Fatalf("Unexpected lookup %v", rules[0].Exprs[3])
+	}
+	if rules, ok := ruleset.Rules(nftables.TableFamilyINet, "fw", "proxy_rules"); !ok || len(rules) != 1 {
+		t.Fatalf("Unexpected rules of proxy_rules %v", rules)
+	}
+
+	// A rule referencing a missing set fails the whole batch
+	handle = NewNftablesHandler()
+	c = caddy.NewTestController("dns", `nftables ip {
+		define set ip fw direct {
+			type ipv4_addr
+		}
+		define chain ip fw output {
+			rule ip daddr @missing accept
+		}
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if err := handle.Provision(); err == nil {
+		t.Fatalf("Expected errors of missing set")
+	}
+	if _, err := ruleset.Open().GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"}, "direct"); err == nil {
+		t.Fatalf("Expected set direct not created")
+	}
+
+	for _, config := range []string{
+		"flags interval",
+		"type ipv4_addr; flags unknown",
+		"type ipv4_addr; size -1",
+		"type ipv4_addr; policy memory",
+		"type ipv4_addr; gc-interval 1m",
+	} {
+		c = caddy.NewTestController("dns", "nftables {\n define set inet fw proxy {\n"+config+"\n}\n}")
+		if err := parse(c, &handle); err == nil {
+			t.Fatalf("Expected errors of %v", config)
+		}
+	}
+	for _, config := range []string{
+		"rule ip6 daddr @proxy accept",
+		"policy drop",
+		"rule accept drop",
+		"type filter hook prerouting",
+	} {
+		c = caddy.NewTestController("dns", "nftables {\n define chain ip fw output {\n"+config+"\n}\n}")
+		if err := parse(c, &handle); err == nil {
+			t.Fatalf("Expected errors of %v", config)
+		}
+	}
+}
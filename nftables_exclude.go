@@ -0,0 +1,56 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Built-in address classes of exclude-cidr
+var excludeClasses = map[string][]string{
+	"loopback":   {"127.0.0.0/8", "::1/128"},
+	"link-local": {"169.254.0.0/16", "fe80::/10"},
+	"private":    {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"},
+	// bogon contains all the other classes and the special purpose addresses which are never routed
+	"bogon": {
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+		"192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24",
+		"203.0.113.0/24", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "100::/64", "2001:db8::/32", "fc00::/7", "fe80::/10", "fec0::/10", "ff00::/8",
+	},
+}
+
+// parseExcludeNetworks parses CIDRs, addresses and names of built-in classes
+func parseExcludeNetworks(values []string) ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+	for _, value := range values {
+		if class, ok := excludeClasses[strings.ToLower(value)]; ok {
+			for _, cidr := range class {
+				_, network, _ := net.ParseCIDR(cidr)
+				ret = append(ret, network)
+			}
+			continue
+		}
+
+		network, err := parseNetwork(value)
+		if err != nil {
+			return nil, fmt.Errorf("exclude-cidr %v invalid, %v", value, err)
+		}
+		ret = append(ret, network)
+	}
+	return ret, nil
+}
+
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExcludedAddress reports whether ip is excluded by exclude-cidr of the plugin block
+func (m *NftablesHandler) isExcludedAddress(ip net.IP) bool {
+	return networksContain(m.Excludes, ip)
+}
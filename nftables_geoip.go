@@ -0,0 +1,232 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbCheckInterval is how often a MaxMind database file is checked for changes
+var mmdbCheckInterval time.Duration = time.Minute
+
+// mmdbRecord decodes both country and ASN databases of MaxMind
+type mmdbRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
+}
+
+// mmdbDatabase is a local MaxMind database which is reloaded when its file changes
+type mmdbDatabase struct {
+	Path string
+
+	lock       sync.RWMutex
+	reader     *maxminddb.Reader
+	modTime    time.Time
+	checkTime  time.Time
+	generation int
+}
+
+func openMmdbDatabase(path string) (*mmdbDatabase, error) {
+	ret := &mmdbDatabase{Path: path}
+	if err := ret.reload(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// reload opens the database file if it's changed, the caller must hold the write lock or own ret
+func (db *mmdbDatabase) reload() error {
+	db.checkTime = time.Now()
+	stat, err := os.Stat(db.Path)
+	if err != nil {
+		return err
+	}
+	if db.reader != nil && stat.ModTime().Equal(db.modTime) {
+		return nil
+	}
+
+	reader, err := maxminddb.Open(db.Path)
+	if err != nil {
+		return err
+	}
+	if db.reader != nil {
+		log.Infof("Nftables reload MaxMind database %v", db.Path)
+		db.reader.Close()
+	}
+	db.reader = reader
+	db.modTime = stat.ModTime()
+	db.generation += 1
+	return nil
+}
+
+// Generation returns the generation of the loaded database, which is increased by every reload
+func (db *mmdbDatabase) Generation() int {
+	db.lock.RLock()
+	if time.Since(db.checkTime) <= mmdbCheckInterval {
+		defer db.lock.RUnlock()
+		return db.generation
+	}
+	db.lock.RUnlock()
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if time.Since(db.checkTime) > mmdbCheckInterval {
+		if err := db.reload(); err != nil {
+			log.Errorf("Nftables reload MaxMind database %v failed, keep the loaded one. %v", db.Path, err)
+		}
+	}
+	return db.generation
+}
+
+func (db *mmdbDatabase) Lookup(ip net.IP) (*mmdbRecord, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	record := &mmdbRecord{}
+	if err := db.reader.Lookup(ip, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// NftablesGeoIP holds the MaxMind databases of a plugin block
+type NftablesGeoIP struct {
+	Country *mmdbDatabase
+	ASN     *mmdbDatabase
+}
+
+// key identifies the databases in the keys of cached locations, blocks with other databases don't share them
+func (geoIP *NftablesGeoIP) key() string {
+	var country, asn string
+	if geoIP.Country != nil {
+		country = geoIP.Country.Path
+	}
+	if geoIP.ASN != nil {
+		asn = geoIP.ASN.Path
+	}
+	return country + "|" + asn
+}
+
+// NftableGeoIPCache is the cached location of an address
+type NftableGeoIPCache struct {
+	Country           string
+	ASN               uint
+	CountryGeneration int
+	ASNGeneration     int
+}
+
+// LookupGeoIP returns the country code and ASN of ip, the results are cached alongside recentlyIPCache
+func (cache *NftablesCache) LookupGeoIP(geoIP *NftablesGeoIP, ip net.IP) (string, uint) {
+	key := ip.String() + " " + geoIP.key()
+	var value *NftableGeoIPCache
+	if cache.geoIPCache != nil {
+		if cached, ok := cache.geoIPCache.Get(key); ok {
+			value = cached.(*NftableGeoIPCache)
+		}
+	}
+	if value == nil {
+		value = &NftableGeoIPCache{CountryGeneration: -1, ASNGeneration: -1}
+		if cache.geoIPCache != nil {
+			cache.geoIPCache.Add(key, value)
+		}
+	}
+
+	if geoIP.Country != nil {
+		if generation := geoIP.Country.Generation(); generation != value.CountryGeneration {
+			record, err := geoIP.Country.Lookup(ip)
+			if err != nil {
+				log.Errorf("Nftables lookup %v in %v failed, %v", ip.String(), geoIP.Country.Path, err)
+			} else {
+				value.Country = record.Country.ISOCode
+				if value.Country == "" {
+					value.Country = record.RegisteredCountry.ISOCode
+				}
+				value.CountryGeneration = generation
+			}
+		}
+	}
+	if geoIP.ASN != nil {
+		if generation := geoIP.ASN.Generation(); generation != value.ASNGeneration {
+			record, err := geoIP.ASN.Lookup(ip)
+			if err != nil {
+				log.Errorf("Nftables lookup %v in %v failed, %v", ip.String(), geoIP.ASN.Path, err)
+			} else {
+				value.ASN = record.AutonomousSystemNumber
+				value.ASNGeneration = generation
+			}
+		}
+	}
+
+	return value.Country, value.ASN
+}
+
+// NftablesGeoIPFilter selects addresses by country code and ASN, values started with ! are excluded
+type NftablesGeoIPFilter struct {
+	Countries        []string
+	ExcludeCountries []string
+	ASNs             []uint
+	ExcludeASNs      []uint
+}
+
+func (f *NftablesGeoIPFilter) HasCountry() bool {
+	return len(f.Countries) > 0 || len(f.ExcludeCountries) > 0
+}
+
+func (f *NftablesGeoIPFilter) HasASN() bool {
+	return len(f.ASNs) > 0 || len(f.ExcludeASNs) > 0
+}
+
+func (f *NftablesGeoIPFilter) AddCountries(values []string) {
+	for _, value := range values {
+		if strings.HasPrefix(value, "!") {
+			f.ExcludeCountries = append(f.ExcludeCountries, strings.ToUpper(value[1:]))
+		} else {
+			f.Countries = append(f.Countries, strings.ToUpper(value))
+		}
+	}
+}
+
+func (f *NftablesGeoIPFilter) AddASNs(values []string) error {
+	for _, value := range values {
+		exclude := strings.HasPrefix(value, "!")
+		number, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimPrefix(strings.ToUpper(value), "!"), "AS"), 10, 32)
+		if err != nil {
+			return fmt.Errorf("asn %v invalid, %v", value, err)
+		}
+		if exclude {
+			f.ExcludeASNs = append(f.ExcludeASNs, uint(number))
+		} else {
+			f.ASNs = append(f.ASNs, uint(number))
+		}
+	}
+	return nil
+}
+
+// Match reports whether the location is selected, an unknown location is only selected by exclusions
+func (f *NftablesGeoIPFilter) Match(country string, asn uint) bool {
+	if len(f.Countries) > 0 && !slices.Contains(f.Countries, country) {
+		return false
+	}
+	if slices.Contains(f.ExcludeCountries, country) {
+		return false
+	}
+	if len(f.ASNs) > 0 && !slices.Contains(f.ASNs, asn) {
+		return false
+	}
+	if slices.Contains(f.ExcludeASNs, asn) {
+		return false
+	}
+	return true
+}
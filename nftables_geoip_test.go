@@ -0,0 +1,138 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// writeTestMmdb writes a MaxMind database of IPv4, which locates every address in country and asn
+func writeTestMmdb(t *testing.T, path string, country string, asn uint32) {
+	str := func(value string) []byte {
+		return append([]byte{0x40 | byte(len(value))}, value...)
+	}
+	uint32Value := func(value uint32) []byte {
+		ret := []byte{0xC0 | 4, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(ret[1:], value)
+		return ret
+	}
+	uint16Value := func(value uint16) []byte {
+		return []byte{0xA0 | 2, byte(value >> 8), byte(value)}
+	}
+	mapValue := func(pairs ...[]byte) []byte {
+		ret := []byte{0xE0 | byte(len(pairs)/2)}
+		for _, pair := range pairs {
+			ret = append(ret, pair...)
+		}
+		return ret
+	}
+
+	var buffer bytes.Buffer
+	// One node whose records both point to the first record of the data section
+	const nodeCount = 1
+	pointer := nodeCount + 16
+	record := []byte{byte(pointer >> 16), byte(pointer >> 8), byte(pointer)}
+	buffer.Write(record)
+	buffer.Write(record)
+	buffer.Write(make([]byte, 16))
+	buffer.Write(mapValue(
+		str("country"), mapValue(str("iso_code"), str(country)),
+		str("autonomous_system_number"), uint32Value(asn),
+	))
+	buffer.WriteString("\xAB\xCD\xEFMaxMind.com")
+	buffer.Write(mapValue(
+		str("node_count"), uint32Value(nodeCount),
+		str("record_size"), uint16Value(24),
+		str("ip_version"), uint16Value(4),
+		str("database_type"), str("test"),
+		str("binary_format_major_version"), uint16Value(2),
+		str("binary_format_minor_version"), uint16Value(0),
+	))
+
+	if err := os.WriteFile(path, buffer.Bytes(), 0600); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+}
+
+func TestGeoIPFilterMatch(t *testing.T) {
+	filter := &NftablesGeoIPFilter{}
+	filter.AddCountries([]string{"us", "!cn"})
+	if err := filter.AddASNs([]string{"!AS4134"}); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	for _, testCase := range []struct {
+		country string
+		asn     uint
+		match   bool
+	}{
+		{"US", 13335, true},
+		{"US", 4134, false},
+		{"CN", 13335, false},
+		{"DE", 13335, false},
+		{"", 0, false},
+	} {
+		if filter.Match(testCase.country, testCase.asn) != testCase.match {
+			t.Errorf("Expected Match(%v, %v) to be %v", testCase.country, testCase.asn, testCase.match)
+		}
+	}
+
+	// An unknown location is only selected by exclusions
+	exclude := &NftablesGeoIPFilter{}
+	exclude.AddCountries([]string{"!CN"})
+	if !exclude.Match("", 0) || exclude.Match("CN", 0) {
+		t.Fatalf("Expected only CN excluded")
+	}
+}
+
+func TestGeoIPFilterASN(t *testing.T) {
+	filter := &NftablesGeoIPFilter{}
+	if err := filter.AddASNs([]string{"AS13335", "15169", "!as4134"}); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if len(filter.ASNs) != 2 || filter.ASNs[0] != 13335 || filter.ASNs[1] != 15169 {
+		t.Fatalf("Expected ASNs 13335 and 15169, but got: %v", filter.ASNs)
+	}
+	if len(filter.ExcludeASNs) != 1 || filter.ExcludeASNs[0] != 4134 {
+		t.Fatalf("Expected excluded ASN 4134, but got: %v", filter.ExcludeASNs)
+	}
+
+	for _, value := range []string{"ASX", "AS", "!", "4294967296"} {
+		if err := (&NftablesGeoIPFilter{}).AddASNs([]string{value}); err == nil {
+			t.Errorf("Expected asn %v invalid", value)
+		}
+	}
+}
+
+func TestLookupGeoIPDatabases(t *testing.T) {
+	dir := t.TempDir()
+	writeTestMmdb(t, filepath.Join(dir, "us.mmdb"), "US", 13335)
+	writeTestMmdb(t, filepath.Join(dir, "cn.mmdb"), "CN", 4134)
+	us, err := openMmdbDatabase(filepath.Join(dir, "us.mmdb"))
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	cn, err := openMmdbDatabase(filepath.Join(dir, "cn.mmdb"))
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	// Blocks with other databases don't read the locations cached by each other
+	geoIPCache, _ := lru.New(16)
+	cache := &NftablesCache{geoIPCache: geoIPCache}
+	ip := net.ParseIP("192.0.2.1")
+	if country, asn := cache.LookupGeoIP(&NftablesGeoIP{Country: us, ASN: us}, ip); country != "US" || asn != 13335 {
+		t.Fatalf("Expected US and 13335, but got: %v, %v", country, asn)
+	}
+	if country, asn := cache.LookupGeoIP(&NftablesGeoIP{Country: cn, ASN: cn}, ip); country != "CN" || asn != 4134 {
+		t.Fatalf("Expected CN and 4134, but got: %v, %v", country, asn)
+	}
+	if country, _ := cache.LookupGeoIP(&NftablesGeoIP{Country: us}, ip); country != "US" {
+		t.Fatalf("Expected US, but got: %v", country)
+	}
+}
@@ -0,0 +1,205 @@
+package coredns_nftables
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// nftablesExclusiveHolder is the member of an exclusive group whose set holds an address, until the element expires
+type nftablesExclusiveHolder struct {
+	rule       *NftablesSetAddElement
+	expireTime time.Time
+}
+
+// exclusiveAdd is an address added by a member of an exclusive group in a response
+type exclusiveAdd struct {
+	rule   *NftablesSetAddElement
+	family nftables.TableFamily
+	ip     net.IP
+}
+
+var exclusiveHoldersLock sync.Mutex = sync.Mutex{}
+var exclusiveHolders = make(map[string]*lru.Cache)
+
+func exclusiveHolderKey(family nftables.TableFamily, ip net.IP) string {
+	return nftCliFamily(family) + " " + ip.String()
+}
+
+// exclusiveHolder returns the member of group which added ip by an earlier response, or nil
+func exclusiveHolder(group string, family nftables.TableFamily, ip net.IP) *NftablesSetAddElement {
+	exclusiveHoldersLock.Lock()
+	defer exclusiveHoldersLock.Unlock()
+
+	holders, ok := exclusiveHolders[group]
+	if !ok {
+		return nil
+	}
+	key := exclusiveHolderKey(family, ip)
+	value, ok := holders.Get(key)
+	if !ok {
+		return nil
+	}
+	holder := value.(*nftablesExclusiveHolder)
+	if !holder.expireTime.IsZero() && time.Now().After(holder.expireTime) {
+		holders.Remove(key)
+		return nil
+	}
+	return holder.rule
+}
+
+// recordExclusiveHolder keeps this member as the one whose set holds ip, after its element is committed
+func (m *NftablesSetAddElement) recordExclusiveHolder(family nftables.TableFamily, ip net.IP) {
+	expireTime := time.Time{}
+	if m.Timeout > 0 {
+		expireTime = time.Now().Add(m.Timeout)
+	}
+
+	exclusiveHoldersLock.Lock()
+	defer exclusiveHoldersLock.Unlock()
+
+	holders, ok := exclusiveHolders[m.ExclusiveGroup]
+	if !ok {
+		holders, _ = lru.New(setLruMaxCount)
+		exclusiveHolders[m.ExclusiveGroup] = holders
+	}
+	holders.Add(exclusiveHolderKey(family, ip), &nftablesExclusiveHolder{rule: m, expireTime: expireTime})
+}
+
+// outranks reports whether rule wins over other in their exclusive group, rules are in the configured order
+func outranks(rules []*NftablesSetAddElement, rule *NftablesSetAddElement, other *NftablesSetAddElement) bool {
+	if rule.Priority != other.Priority {
+		return rule.Priority > other.Priority
+	}
+	for _, r := range rules {
+		if r == rule {
+			return true
+		}
+		if r == other {
+			return false
+		}
+	}
+	return false
+}
+
+// skipHeldExclusiveRules drops the matched members of groups whose address is still held by a member of higher
+// priority, which was added by an earlier response. So the address is not moved into a lower priority set only
+// because the later response doesn't match the holder.
+func skipHeldExclusiveRules(rules []*NftablesSetAddElement, matched []*NftablesSetAddElement, family nftables.TableFamily, ip net.IP) []*NftablesSetAddElement {
+	holders := make(map[string]*NftablesSetAddElement)
+	var ret []*NftablesSetAddElement
+	for _, rule := range matched {
+		if rule.ExclusiveGroup == "" {
+			ret = append(ret, rule)
+			continue
+		}
+		holder, ok := holders[rule.ExclusiveGroup]
+		if !ok {
+			holder = exclusiveHolder(rule.ExclusiveGroup, family, ip)
+			holders[rule.ExclusiveGroup] = holder
+		}
+		if holder == nil || holder == rule || !outranks(rules, holder, rule) {
+			ret = append(ret, rule)
+		}
+	}
+	return ret
+}
+
+// selectExclusiveRules picks the matched rule of the highest priority of every exclusive group.
+// It returns the rules to apply, and the other rules of the picked groups whose sets should not
+// contain the address. Rules with the same priority are picked by the configured order.
+func selectExclusiveRules(rules []*NftablesSetAddElement, matched []*NftablesSetAddElement) ([]*NftablesSetAddElement, []*NftablesSetAddElement) {
+	winners := make(map[string]*NftablesSetAddElement)
+	for _, rule := range matched {
+		if rule.ExclusiveGroup == "" {
+			continue
+		}
+		if winner, ok := winners[rule.ExclusiveGroup]; !ok || rule.Priority > winner.Priority {
+			winners[rule.ExclusiveGroup] = rule
+		}
+	}
+
+	var apply []*NftablesSetAddElement
+	for _, rule := range matched {
+		if rule.ExclusiveGroup == "" || winners[rule.ExclusiveGroup] == rule {
+			apply = append(apply, rule)
+		}
+	}
+
+	var remove []*NftablesSetAddElement
+	for _, rule := range rules {
+		if _, ok := winners[rule.ExclusiveGroup]; !ok || rule.ExclusiveGroup == "" {
+			continue
+		}
+
+		sameSet := false
+		for _, other := range append(apply, remove...) {
+			if other.target() == rule.target() {
+				sameSet = true
+				break
+			}
+		}
+		if !sameSet {
+			remove = append(remove, rule)
+		}
+	}
+
+	return apply, remove
+}
+
+// target names the set, ipset or routing table which the rule modifies
+func (m *NftablesSetAddElement) target() string {
+	if m.IPSet {
+		return "ipset " + m.SetName
+	}
+	if m.Route != nil {
+		return "route " + m.Route.String()
+	}
+	return "set " + m.TableName + " " + m.SetName
+}
+
+// ServeDeleteIP removes a single address from the set, in the same batch of additions.
+// The address is added before deletion, so deleting an address which is not in the set
+// doesn't fail the whole batch.
+func (m *NftablesSetAddElement) ServeDeleteIP(ctx context.Context, cache *NftablesCache, ip net.IP, family nftables.TableFamily) error {
+	if m.IPSet {
+		return m.ServeDeleteIPSet(ctx, cache, ip)
+	}
+	if m.Route != nil {
+		return m.ServeDeleteRoute(ctx, cache, ip)
+	}
+	cache, err := cache.OfNetns(m.Netns)
+	if err != nil {
+		return err
+	}
+	tableCache := cache.GetNftablesTable(family, m.TableName)
+	if tableCache == nil {
+		return nil
+	}
+	set, _ := cache.GetSet(tableCache, m.SetName)
+	if set == nil {
+		return nil
+	}
+
+	key := ip.To4()
+	if key == nil {
+		key = ip.To16()
+		if set.KeyType == nftables.TypeIPAddr {
+			return nil
+		}
+	} else if set.KeyType == nftables.TypeIP6Addr {
+		return nil
+	}
+
+	log.Debugf("Nftables set %v %v %v delete element %s of exclusive group %v", cache.GetFamilyName(family), m.TableName, m.SetName, ip.String(), m.ExclusiveGroup)
+	elements := []nftables.SetElement{{Key: key}}
+	m.forgetActiveElement(family, ip.String())
+	if err := cache.SetAddElements(tableCache, set, elements, ip.String()); err != nil {
+		return err
+	}
+	return cache.SetDeleteElements(tableCache, set, elements, ip.String())
+}
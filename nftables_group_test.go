@@ -0,0 +1,51 @@
+package coredns_nftables
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/miekg/dns"
+)
+
+func TestExclusiveGroupAcrossResponses(t *testing.T) {
+	ruleset := withMemoryBackend(t)
+	exclusiveHolders = make(map[string]*lru.Cache)
+	defer func() { exclusiveHolders = make(map[string]*lru.Cache) }()
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		set add element fw proxy ip false exclusive-group route priority 10 domain example.org
+		set add element fw direct ip false exclusive-group route
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	serve := func(name string, ip string) {
+		r := new(dns.Msg)
+		r.SetQuestion(name, dns.TypeA)
+		r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP(ip)})
+		if _, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1"))); err != nil {
+			t.Fatalf("Expected no errors, but got: %v", err)
+		}
+	}
+
+	// A shared address stays in the set of the higher priority, when a later response only matches the lower one
+	serve("example.org.", "192.0.2.1")
+	serve("cdn.example.net.", "192.0.2.1")
+	if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.1")) ||
+		ruleset.Contains(nftables.TableFamilyIPv4, "fw", "direct", net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Expected 192.0.2.1 kept in proxy")
+	}
+
+	// An address of the lower priority is still moved by a later response of the higher one
+	serve("cdn.example.net.", "192.0.2.2")
+	serve("example.org.", "192.0.2.2")
+	if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.2")) ||
+		ruleset.Contains(nftables.TableFamilyIPv4, "fw", "direct", net.ParseIP("192.0.2.2")) {
+		t.Fatalf("Expected 192.0.2.2 moved into proxy")
+	}
+}
@@ -0,0 +1,224 @@
+package coredns_nftables
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// NftablesIPSetBackend is the part of *netlink.Handle used by ipset rules
+type NftablesIPSetBackend interface {
+	IpsetList(name string) (*netlink.IPSetResult, error)
+	IpsetCreate(setname, typename string, options netlink.IpsetCreateOptions) error
+	IpsetAdd(setname string, entry *netlink.IPSetEntry) error
+	IpsetDel(setname string, entry *netlink.IPSetEntry) error
+}
+
+// NftablesIPSetBackendFactory opens the ipset connection of a cache when an ipset rule is served
+type NftablesIPSetBackendFactory func() (NftablesIPSetBackend, error)
+
+var ipsetBackendFactory NftablesIPSetBackendFactory = openSystemIPSetConn
+
+func openSystemIPSetConn() (NftablesIPSetBackend, error) {
+	handle, err := netlink.NewHandle(unix.NETLINK_NETFILTER)
+	if err != nil {
+		log.Errorf("Nftables call netlink.NewHandle() for ipset failed: %v", err)
+		return nil, err
+	}
+	return handle, nil
+}
+
+// SetIPSetBackendFactory replaces the ipset connections of new caches, nil restores the netlink connections
+func SetIPSetBackendFactory(factory NftablesIPSetBackendFactory) {
+	if factory == nil {
+		factory = openSystemIPSetConn
+	}
+	ipsetBackendFactory = factory
+}
+
+// GetIPSetHeader returns the type, family and flags of an ipset, or nil if it's not found
+func (cache *NftablesCache) GetIPSetHeader(setName string) (*netlink.IPSetResult, error) {
+	if header, ok := cache.ipsetHeaders[setName]; ok {
+		return header, nil
+	}
+
+	if cache.IPSetConnection == nil {
+		conn, err := ipsetBackendFactory()
+		if err != nil {
+			return nil, err
+		}
+		cache.IPSetConnection = conn
+	}
+
+	header, err := cache.IPSetConnection.IpsetList(setName)
+	if errors.Is(err, unix.ENOENT) {
+		return nil, nil
+	} else if err != nil {
+		cache.ipsetFailed(err)
+		return nil, err
+	}
+	// Only the header is kept
+	header.Entries = nil
+	cache.ipsetHeaders[setName] = header
+	return header, nil
+}
+
+func (cache *NftablesCache) closeIPSetConnection() {
+	if handle, ok := cache.IPSetConnection.(*netlink.Handle); ok {
+		handle.Close()
+	}
+	cache.IPSetConnection = nil
+}
+
+// ipsetFailed reopens the ipset connection and reloads headers after its failure, an entry rejected by the kernel keeps it.
+// The nftables connection of cache is not affected by either.
+func (cache *NftablesCache) ipsetFailed(err error) {
+	var ipsetErr nl.IPSetError
+	if !isNftablesOperationError(err) && !errors.As(err, &ipsetErr) {
+		cache.closeIPSetConnection()
+		cache.ipsetHeaders = make(map[string]*netlink.IPSetResult)
+	}
+}
+
+// ipsetTypeName returns the ipset type of rule
+func (m *NftablesSetAddElement) ipsetTypeName() string {
+	if m.Interval {
+		return "hash:net"
+	}
+	return "hash:ip"
+}
+
+// ServeIPSet adds the network into the ipset SetName, a single address is added without CIDR
+func (m *NftablesSetAddElement) ServeIPSet(ctx context.Context, cache *NftablesCache, network *net.IPNet) (error, bool) {
+	header, err := cache.GetIPSetHeader(m.SetName)
+	if err != nil {
+		log.Errorf("Nftables ipset %v add element %s but get header failed. %v", m.SetName, network.String(), err)
+		return err, false
+	}
+	entry, ok := m.newIPSetEntry(header, network)
+	if !ok {
+		return nil, true
+	}
+
+	if header == nil && strictMode {
+		err := errStrictNotFound("ipset", m.SetName)
+		log.Errorf("Nftables ipset %v add element %s failed. %v", m.SetName, network.String(), err)
+		return err, false
+	}
+	if header == nil {
+		createOptions := netlink.IpsetCreateOptions{Replace: true, Comments: true, Family: unix.AF_INET}
+		if network.IP.To4() == nil {
+			createOptions.Family = unix.AF_INET6
+		}
+		if timeout := ipsetTimeout(m.Timeout); timeout > 0 {
+			createOptions.Timeout = &timeout
+		}
+
+		log.Debugf("Nftables create ipset %v %v and add element %s", m.SetName, m.ipsetTypeName(), network.String())
+		if err := cache.IPSetConnection.IpsetCreate(m.SetName, m.ipsetTypeName(), createOptions); err != nil {
+			log.Errorf("Nftables create ipset %v %v and add element %s but create failed. %v", m.SetName, m.ipsetTypeName(), network.String(), err)
+			cache.ipsetFailed(err)
+			return err, false
+		}
+		header, err = cache.GetIPSetHeader(m.SetName)
+		if err != nil || header == nil {
+			log.Errorf("Nftables create ipset %v %v and add element %s but get header failed. %v", m.SetName, m.ipsetTypeName(), network.String(), err)
+			return err, false
+		}
+		if entry, ok = m.newIPSetEntry(header, network); !ok {
+			return nil, true
+		}
+	}
+
+	log.Debugf("Nftables ipset %v add element %s", m.SetName, network.String())
+	if err := cache.IPSetConnection.IpsetAdd(m.SetName, entry); err != nil {
+		delete(cache.ipsetHeaders, m.SetName)
+		cache.ipsetFailed(err)
+		return err, false
+	}
+	return nil, false
+}
+
+// ServeDeleteIPSet removes a single address from the ipset SetName, a missing entry is not an error
+func (m *NftablesSetAddElement) ServeDeleteIPSet(ctx context.Context, cache *NftablesCache, ip net.IP) error {
+	header, err := cache.GetIPSetHeader(m.SetName)
+	if err != nil || header == nil {
+		return err
+	}
+	entry, ok := m.newIPSetEntry(header, hostNetwork(ip))
+	if !ok {
+		return nil
+	}
+
+	log.Debugf("Nftables ipset %v delete element %s of exclusive group %v", m.SetName, ip.String(), m.ExclusiveGroup)
+	entry.Timeout = nil
+	entry.Comment = ""
+	if err := cache.IPSetConnection.IpsetDel(m.SetName, entry); err != nil {
+		delete(cache.ipsetHeaders, m.SetName)
+		cache.ipsetFailed(err)
+		return err
+	}
+	return nil
+}
+
+// newIPSetEntry returns the entry of network in the ipset of header, which is nil if the ipset is not created yet.
+// It returns false if the network doesn't fit the ipset.
+func (m *NftablesSetAddElement) newIPSetEntry(header *netlink.IPSetResult, network *net.IPNet) (*netlink.IPSetEntry, bool) {
+	isIPv6 := network.IP.To4() == nil
+	if (isIPv6 && m.KeyType == nftables.TypeIPAddr) || (!isIPv6 && m.KeyType == nftables.TypeIP6Addr) {
+		return nil, false
+	}
+
+	typeName := m.ipsetTypeName()
+	entry := &netlink.IPSetEntry{IP: network.IP, Replace: true}
+	if header != nil {
+		if (isIPv6 && header.Family != unix.AF_INET6) || (!isIPv6 && header.Family != unix.AF_INET) {
+			log.Debugf("Nftables ipset %v ignore element %s because family mismatch", m.SetName, network.String())
+			return nil, false
+		}
+		typeName = header.TypeName
+	}
+
+	ones, bits := network.Mask.Size()
+	switch typeName {
+	case "hash:ip":
+		if ones != bits {
+			log.Debugf("Nftables ipset %v ignore element %s because it's a hash:ip ipset", m.SetName, network.String())
+			return nil, false
+		}
+	case "hash:net":
+		if ones != bits {
+			entry.CIDR = uint8(ones)
+		}
+	default:
+		log.Debugf("Nftables ipset %v ignore element %s because type %v is not supported", m.SetName, network.String(), typeName)
+		return nil, false
+	}
+
+	if header != nil {
+		if timeout := ipsetTimeout(m.Timeout); timeout > 0 && header.Timeout != nil {
+			entry.Timeout = &timeout
+		}
+		if m.Comment != "" && header.CadtFlags&nl.IPSET_FLAG_WITH_COMMENT != 0 {
+			entry.Comment = m.Comment
+		}
+	}
+	return entry, true
+}
+
+// ipsetTimeout converts a timeout into seconds, a positive timeout is at least one second
+func ipsetTimeout(timeout time.Duration) uint32 {
+	if timeout <= 0 {
+		return 0
+	}
+	if timeout < time.Second {
+		return 1
+	}
+	return uint32(timeout / time.Second)
+}
@@ -0,0 +1,117 @@
+package coredns_nftables
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+type testIPSetBackend struct {
+	sets map[string]*netlink.IPSetResult
+	// err fails IpsetAdd
+	err error
+}
+
+func (b *testIPSetBackend) IpsetList(name string) (*netlink.IPSetResult, error) {
+	set, ok := b.sets[name]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	ret := *set
+	return &ret, nil
+}
+
+func (b *testIPSetBackend) IpsetCreate(setname, typename string, options netlink.IpsetCreateOptions) error {
+	set := &netlink.IPSetResult{SetName: setname, TypeName: typename, Family: options.Family, Timeout: options.Timeout}
+	if options.Comments {
+		set.CadtFlags |= nl.IPSET_FLAG_WITH_COMMENT
+	}
+	b.sets[setname] = set
+	return nil
+}
+
+func (b *testIPSetBackend) IpsetAdd(setname string, entry *netlink.IPSetEntry) error {
+	if b.err != nil {
+		return b.err
+	}
+	b.sets[setname].Entries = append(b.sets[setname].Entries, *entry)
+	return nil
+}
+
+func (b *testIPSetBackend) IpsetDel(setname string, entry *netlink.IPSetEntry) error {
+	return nil
+}
+
+func TestIPSetServeWorker(t *testing.T) {
+	backend := &testIPSetBackend{sets: map[string]*netlink.IPSetResult{
+		"direct": {SetName: "direct", TypeName: "hash:net", Family: unix.AF_INET6},
+	}}
+	withMemoryBackend(t)
+	SetIPSetBackendFactory(func() (NftablesIPSetBackend, error) { return backend, nil })
+	defer SetIPSetBackendFactory(nil)
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		ipset add proxy ip hash:ip 1h comment via coredns domain example.org
+		ipset add direct ip6 hash:net
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")})
+	r.Answer = append(r.Answer, &dns.AAAA{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::1")})
+	if _, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1"))); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	proxy := backend.sets["proxy"]
+	if proxy == nil || proxy.TypeName != "hash:ip" || proxy.Family != unix.AF_INET || len(proxy.Entries) != 1 {
+		t.Fatalf("Expected hash:ip ipset proxy with one entry, but got: %v", proxy)
+	}
+	if entry := proxy.Entries[0]; !entry.IP.Equal(net.ParseIP("192.0.2.1")) || entry.Comment != "via coredns" ||
+		entry.Timeout == nil || *entry.Timeout != 3600 {
+		t.Fatalf("Unexpected entry %v", entry)
+	}
+
+	// The existing hash:net ipset of IPv6 only accepts the AAAA answer
+	direct := backend.sets["direct"]
+	if len(direct.Entries) != 1 || !direct.Entries[0].IP.Equal(net.ParseIP("2001:db8::1")) || direct.Entries[0].Timeout != nil {
+		t.Fatalf("Unexpected entries of direct %v", direct.Entries)
+	}
+
+	// An entry rejected by the kernel keeps the connections, a failed ipset connection is reopened alone
+	cache, err := NewCache()
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	defer CloseCache(cache)
+	rule := handle.MutableRuleSet(nftables.TableFamilyIPv4).RuleAddElement[0]
+	backend.err = nl.IPSetError(nl.IPSET_ERR_EXIST)
+	if err, _ := rule.ServeIPSet(context.Background(), cache, hostNetwork(net.ParseIP("192.0.2.2"))); err == nil || cache.IPSetConnection == nil || cache.HasNftableConnectionError {
+		t.Fatalf("Expected the rejected entry keeps connections, but got: %v, %v", err, cache.HasNftableConnectionError)
+	}
+	backend.err = errors.New("receive: connection reset")
+	if err, _ := rule.ServeIPSet(context.Background(), cache, hostNetwork(net.ParseIP("192.0.2.2"))); err == nil || cache.IPSetConnection != nil || cache.HasNftableConnectionError {
+		t.Fatalf("Expected only the ipset connection closed, but got: %v, %v", err, cache.HasNftableConnectionError)
+	}
+	backend.err = nil
+
+	// An ipset can't be created for both families
+	auto := NewNftablesHandler()
+	if err := parse(caddy.NewTestController("dns", `nftables {
+		ipset add mixed auto
+	}`), &auto); err == nil {
+		t.Fatalf("Expected ipset family auto rejected")
+	}
+}
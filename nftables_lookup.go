@@ -0,0 +1,63 @@
+package coredns_nftables
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// lookupResponseWriter is the dns.ResponseWriter of queries sent by this plugin itself,
+// it captures the response and never writes to a client.
+type lookupResponseWriter struct {
+	Msg *dns.Msg
+}
+
+func (w *lookupResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *lookupResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+}
+
+func (w *lookupResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.Msg = m
+	return nil
+}
+
+func (w *lookupResponseWriter) Write(buf []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		return 0, err
+	}
+	w.Msg = m
+	return len(buf), nil
+}
+
+func (w *lookupResponseWriter) Close() error        { return nil }
+func (w *lookupResponseWriter) TsigStatus() error   { return nil }
+func (w *lookupResponseWriter) TsigTimersOnly(bool) {}
+func (w *lookupResponseWriter) Hijack()             {}
+
+// lookup resolves name through the next plugins of the chain.
+func (m *NftablesHandler) lookup(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	if m.Next == nil {
+		return nil, fmt.Errorf("no next plugin to lookup %v", name)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.SetEdns0(4096, false)
+
+	w := &lookupResponseWriter{}
+	if _, err := m.Next.ServeDNS(ctx, w, req); err != nil {
+		return nil, err
+	}
+	if w.Msg == nil {
+		return nil, fmt.Errorf("no answer received when lookup %v %v", name, dns.TypeToString[qtype])
+	}
+
+	return w.Msg, nil
+}
@@ -0,0 +1,495 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netns"
+)
+
+type nftablesMemoryTableKey struct {
+	family nftables.TableFamily
+	name   string
+}
+
+// nftablesMemoryElement is an element of a plain set, or an interval of an interval set
+type nftablesMemoryElement struct {
+	key []byte
+	// end is exclusive, nil means the interval reaches the last address
+	end     []byte
+	expires time.Time
+	comment string
+}
+
+type nftablesMemorySet struct {
+	set      nftables.Set
+	elements map[string]*nftablesMemoryElement
+}
+
+type nftablesMemoryChain struct {
+	chain nftables.Chain
+	rules []*nftables.Rule
+}
+
+type nftablesMemoryTable struct {
+	table  nftables.Table
+	sets   map[string]*nftablesMemorySet
+	chains map[string]*nftablesMemoryChain
+}
+
+// NftablesMemoryRuleset is an in-memory nftables ruleset, which is shared by the connections of Open.
+// It models key types, element timeouts, interval sets and atomic batches of the kernel.
+// Chains keep their rules, which are checked for referenced sets and chains but never evaluated.
+type NftablesMemoryRuleset struct {
+	lock   sync.Mutex
+	now    func() time.Time
+	tables map[nftablesMemoryTableKey]*nftablesMemoryTable
+}
+
+func NewNftablesMemoryRuleset() *NftablesMemoryRuleset {
+	return &NftablesMemoryRuleset{
+		now:    time.Now,
+		tables: make(map[nftablesMemoryTableKey]*nftablesMemoryTable),
+	}
+}
+
+var _ NftablesChainBackend = (*nftablesMemoryConn)(nil)
+
+// Open returns a new connection to the ruleset
+func (r *NftablesMemoryRuleset) Open() NftablesBackend {
+	return &nftablesMemoryConn{ruleset: r}
+}
+
+// Factory returns a factory of connections to the ruleset for SetNftablesBackendFactory
+func (r *NftablesMemoryRuleset) Factory() NftablesBackendFactory {
+	return func() (NftablesBackend, netns.NsHandle, error) {
+		return r.Open(), 0, nil
+	}
+}
+
+// Contains reports whether ip is an element, or in an interval, of the set
+func (r *NftablesMemoryRuleset) Contains(family nftables.TableFamily, tableName string, setName string, ip net.IP) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	s, err := r.findSet(r.tables, family, tableName, setName)
+	if err != nil {
+		return false
+	}
+	key := ip.To4()
+	if key == nil || s.set.KeyType == nftables.TypeIP6Addr {
+		key = ip.To16()
+	}
+
+	now := r.now()
+	for _, element := range s.elements {
+		if element.expired(now) {
+			continue
+		}
+		if !s.set.Interval {
+			if bytes.Equal(element.key, key) {
+				return true
+			}
+			continue
+		}
+		if len(element.key) == len(key) && bytes.Compare(key, element.key) >= 0 && (element.end == nil || bytes.Compare(key, element.end) < 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules returns the rules of the chain, and whether the chain exists
+func (r *NftablesMemoryRuleset) Rules(family nftables.TableFamily, tableName string, chainName string) ([]*nftables.Rule, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	table, ok := r.tables[nftablesMemoryTableKey{family: family, name: tableName}]
+	if !ok {
+		return nil, false
+	}
+	chain, ok := table.chains[chainName]
+	if !ok {
+		return nil, false
+	}
+	return append([]*nftables.Rule(nil), chain.rules...), true
+}
+
+func (element *nftablesMemoryElement) expired(now time.Time) bool {
+	return !element.expires.IsZero() && !now.Before(element.expires)
+}
+
+func (r *NftablesMemoryRuleset) findSet(tables map[nftablesMemoryTableKey]*nftablesMemoryTable, family nftables.TableFamily, tableName string, setName string) (*nftablesMemorySet, error) {
+	table, ok := tables[nftablesMemoryTableKey{family: family, name: tableName}]
+	if !ok {
+		return nil, fmt.Errorf("table %v not found: %w", tableName, syscall.ENOENT)
+	}
+	s, ok := table.sets[setName]
+	if !ok {
+		return nil, fmt.Errorf("set %v %v not found: %w", tableName, setName, syscall.ENOENT)
+	}
+	return s, nil
+}
+
+func cloneNftablesMemoryTables(tables map[nftablesMemoryTableKey]*nftablesMemoryTable) map[nftablesMemoryTableKey]*nftablesMemoryTable {
+	ret := make(map[nftablesMemoryTableKey]*nftablesMemoryTable, len(tables))
+	for key, table := range tables {
+		tableCopy := &nftablesMemoryTable{table: table.table, sets: make(map[string]*nftablesMemorySet, len(table.sets)), chains: make(map[string]*nftablesMemoryChain, len(table.chains))}
+		for name, chain := range table.chains {
+			tableCopy.chains[name] = &nftablesMemoryChain{chain: chain.chain, rules: append([]*nftables.Rule(nil), chain.rules...)}
+		}
+		for name, s := range table.sets {
+			setCopy := &nftablesMemorySet{set: s.set, elements: make(map[string]*nftablesMemoryElement, len(s.elements))}
+			for elementKey, element := range s.elements {
+				elementCopy := *element
+				setCopy.elements[elementKey] = &elementCopy
+			}
+			tableCopy.sets[name] = setCopy
+		}
+		ret[key] = tableCopy
+	}
+	return ret
+}
+
+// nftablesMemoryConn queues modifications until Flush like *nftables.Conn
+type nftablesMemoryConn struct {
+	ruleset *NftablesMemoryRuleset
+	batch   []func(tables map[nftablesMemoryTableKey]*nftablesMemoryTable, now time.Time) error
+}
+
+func (c *nftablesMemoryConn) ListTablesOfFamily(family nftables.TableFamily) ([]*nftables.Table, error) {
+	c.ruleset.lock.Lock()
+	defer c.ruleset.lock.Unlock()
+
+	var ret []*nftables.Table
+	for key, table := range c.ruleset.tables {
+		if key.family == family {
+			tableCopy := table.table
+			ret = append(ret, &tableCopy)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+	return ret, nil
+}
+
+func (c *nftablesMemoryConn) AddTable(t *nftables.Table) *nftables.Table {
+	table := *t
+	c.batch = append(c.batch, func(tables map[nftablesMemoryTableKey]*nftablesMemoryTable, now time.Time) error {
+		key := nftablesMemoryTableKey{family: table.Family, name: table.Name}
+		if _, ok := tables[key]; !ok {
+			tables[key] = &nftablesMemoryTable{table: table, sets: make(map[string]*nftablesMemorySet), chains: make(map[string]*nftablesMemoryChain)}
+		}
+		return nil
+	})
+	return t
+}
+
+func (c *nftablesMemoryConn) GetSetByName(t *nftables.Table, name string) (*nftables.Set, error) {
+	c.ruleset.lock.Lock()
+	defer c.ruleset.lock.Unlock()
+
+	s, err := c.ruleset.findSet(c.ruleset.tables, t.Family, t.Name, name)
+	if err != nil {
+		return nil, err
+	}
+	ret := s.set
+	table := c.ruleset.tables[nftablesMemoryTableKey{family: t.Family, name: t.Name}].table
+	ret.Table = &table
+	return &ret, nil
+}
+
+func (c *nftablesMemoryConn) AddSet(s *nftables.Set, vals []nftables.SetElement) error {
+	if s.Table == nil {
+		return fmt.Errorf("set %v without table: %w", s.Name, syscall.EINVAL)
+	}
+	if s.KeyType.Bytes == 0 {
+		return fmt.Errorf("set %v with invalid key type %v: %w", s.Name, s.KeyType.Name, syscall.EINVAL)
+	}
+	set := *s
+	table := *s.Table
+	set.Table = &table
+	elements := append([]nftables.SetElement(nil), vals...)
+	c.batch = append(c.batch, func(tables map[nftablesMemoryTableKey]*nftablesMemoryTable, now time.Time) error {
+		memoryTable, ok := tables[nftablesMemoryTableKey{family: table.Family, name: table.Name}]
+		if !ok {
+			return fmt.Errorf("table %v not found: %w", table.Name, syscall.ENOENT)
+		}
+		memorySet, ok := memoryTable.sets[set.Name]
+		if !ok {
+			memorySet = &nftablesMemorySet{set: set, elements: make(map[string]*nftablesMemoryElement)}
+			memoryTable.sets[set.Name] = memorySet
+		} else if old := memorySet.set; old.KeyType.Name != set.KeyType.Name || old.Interval != set.Interval ||
+			old.HasTimeout != set.HasTimeout || old.Constant != set.Constant {
+			// An existing set with different key type or flags can't be added again
+			return fmt.Errorf("set %v %v exists with different type or flags: %w", table.Name, set.Name, syscall.EEXIST)
+		}
+		return memorySet.add(elements, now)
+	})
+	return nil
+}
+
+func (c *nftablesMemoryConn) AddChain(ch *nftables.Chain) *nftables.Chain {
+	chain := *ch
+	table := *ch.Table
+	chain.Table = &table
+	c.batch = append(c.batch, func(tables map[nftablesMemoryTableKey]*nftablesMemoryTable, now time.Time) error {
+		memoryTable, ok := tables[nftablesMemoryTableKey{family: table.Family, name: table.Name}]
+		if !ok {
+			return fmt.Errorf("table %v not found: %w", table.Name, syscall.ENOENT)
+		}
+		if memoryChain, ok := memoryTable.chains[chain.Name]; ok {
+			memoryChain.chain = chain
+		} else {
+			memoryTable.chains[chain.Name] = &nftablesMemoryChain{chain: chain}
+		}
+		return nil
+	})
+	return ch
+}
+
+func (c *nftablesMemoryConn) FlushChain(ch *nftables.Chain) {
+	family, tableName, chainName := ch.Table.Family, ch.Table.Name, ch.Name
+	c.batch = append(c.batch, func(tables map[nftablesMemoryTableKey]*nftablesMemoryTable, now time.Time) error {
+		memoryChain, err := findMemoryChain(tables, family, tableName, chainName)
+		if err != nil {
+			return err
+		}
+		memoryChain.rules = nil
+		return nil
+	})
+}
+
+// AddRule appends r to its chain, the sets of lookups and the chains of jumps must exist when the batch is applied
+func (c *nftablesMemoryConn) AddRule(r *nftables.Rule) *nftables.Rule {
+	rule := *r
+	family, tableName, chainName := r.Table.Family, r.Table.Name, r.Chain.Name
+	c.batch = append(c.batch, func(tables map[nftablesMemoryTableKey]*nftablesMemoryTable, now time.Time) error {
+		memoryChain, err := findMemoryChain(tables, family, tableName, chainName)
+		if err != nil {
+			return err
+		}
+		for _, e := range rule.Exprs {
+			switch e := e.(type) {
+			case *expr.Lookup:
+				if _, err := c.ruleset.findSet(tables, family, tableName, e.SetName); err != nil {
+					return err
+				}
+			case *expr.Verdict:
+				if e.Kind == expr.VerdictJump || e.Kind == expr.VerdictGoto {
+					if _, err := findMemoryChain(tables, family, tableName, e.Chain); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		memoryChain.rules = append(memoryChain.rules, &rule)
+		return nil
+	})
+	return r
+}
+
+func findMemoryChain(tables map[nftablesMemoryTableKey]*nftablesMemoryTable, family nftables.TableFamily, tableName string, chainName string) (*nftablesMemoryChain, error) {
+	table, ok := tables[nftablesMemoryTableKey{family: family, name: tableName}]
+	if !ok {
+		return nil, fmt.Errorf("table %v not found: %w", tableName, syscall.ENOENT)
+	}
+	chain, ok := table.chains[chainName]
+	if !ok {
+		return nil, fmt.Errorf("chain %v %v not found: %w", tableName, chainName, syscall.ENOENT)
+	}
+	return chain, nil
+}
+
+func (c *nftablesMemoryConn) SetAddElements(s *nftables.Set, vals []nftables.SetElement) error {
+	return c.queueElements(s, vals, (*nftablesMemorySet).add)
+}
+
+func (c *nftablesMemoryConn) SetDeleteElements(s *nftables.Set, vals []nftables.SetElement) error {
+	return c.queueElements(s, vals, (*nftablesMemorySet).delete)
+}
+
+func (c *nftablesMemoryConn) queueElements(s *nftables.Set, vals []nftables.SetElement, apply func(*nftablesMemorySet, []nftables.SetElement, time.Time) error) error {
+	if s.Table == nil {
+		return fmt.Errorf("set %v without table: %w", s.Name, syscall.EINVAL)
+	}
+	family, tableName, setName := s.Table.Family, s.Table.Name, s.Name
+	elements := append([]nftables.SetElement(nil), vals...)
+	c.batch = append(c.batch, func(tables map[nftablesMemoryTableKey]*nftablesMemoryTable, now time.Time) error {
+		memorySet, err := c.ruleset.findSet(tables, family, tableName, setName)
+		if err != nil {
+			return err
+		}
+		return apply(memorySet, elements, now)
+	})
+	return nil
+}
+
+func (c *nftablesMemoryConn) GetSetElements(s *nftables.Set) ([]nftables.SetElement, error) {
+	c.ruleset.lock.Lock()
+	defer c.ruleset.lock.Unlock()
+
+	if s.Table == nil {
+		return nil, fmt.Errorf("set %v without table: %w", s.Name, syscall.EINVAL)
+	}
+	memorySet, err := c.ruleset.findSet(c.ruleset.tables, s.Table.Family, s.Table.Name, s.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := c.ruleset.now()
+	var ret []nftables.SetElement
+	for _, element := range memorySet.elements {
+		if element.expired(now) {
+			continue
+		}
+		start := nftables.SetElement{Key: append([]byte(nil), element.key...), Comment: element.comment}
+		if !element.expires.IsZero() {
+			start.Expires = element.expires.Sub(now)
+		}
+		ret = append(ret, start)
+		if memorySet.set.Interval && element.end != nil {
+			ret = append(ret, nftables.SetElement{Key: append([]byte(nil), element.end...), IntervalEnd: true})
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if compare := bytes.Compare(ret[i].Key, ret[j].Key); compare != 0 {
+			return compare < 0
+		}
+		return ret[i].IntervalEnd && !ret[j].IntervalEnd
+	})
+	return ret, nil
+}
+
+// Discard drops the queued modifications
+func (c *nftablesMemoryConn) Discard() error {
+	c.batch = nil
+	return nil
+}
+
+// Flush applies the queued modifications, none of them is applied if any one fails
+func (c *nftablesMemoryConn) Flush() error {
+	batch := c.batch
+	c.batch = nil
+
+	c.ruleset.lock.Lock()
+	defer c.ruleset.lock.Unlock()
+
+	now := c.ruleset.now()
+	tables := cloneNftablesMemoryTables(c.ruleset.tables)
+	for _, apply := range batch {
+		if err := apply(tables, now); err != nil {
+			return err
+		}
+	}
+	c.ruleset.tables = tables
+	return nil
+}
+
+// intervals converts elements into intervals, an interval ends with the next IntervalEnd element or KeyEnd
+func (s *nftablesMemorySet) intervals(vals []nftables.SetElement) ([]*nftablesMemoryElement, error) {
+	var ret []*nftablesMemoryElement
+	var start *nftablesMemoryElement
+	for i := range vals {
+		if vals[i].IntervalEnd {
+			if !s.set.Interval {
+				return nil, fmt.Errorf("interval end of set %v without interval flag: %w", s.set.Name, syscall.EINVAL)
+			}
+			if start != nil {
+				start.end = vals[i].Key
+				start = nil
+			}
+			continue
+		}
+
+		element := &nftablesMemoryElement{key: vals[i].Key, comment: vals[i].Comment}
+		if len(vals[i].KeyEnd) > 0 {
+			element.end = nextAddress(vals[i].KeyEnd)
+		} else if s.set.Interval {
+			start = element
+		}
+		ret = append(ret, element)
+	}
+
+	for i, element := range ret {
+		if !s.set.Concatenation && len(element.key) != int(s.set.KeyType.Bytes) {
+			return nil, fmt.Errorf("element %v of set %v mismatch key type %v: %w", net.IP(element.key), s.set.Name, s.set.KeyType.Name, syscall.EINVAL)
+		}
+		if element.end != nil && (len(element.end) != len(element.key) || bytes.Compare(element.key, element.end) >= 0) {
+			return nil, fmt.Errorf("interval %v-%v of set %v invalid: %w", net.IP(element.key), net.IP(element.end), s.set.Name, syscall.EINVAL)
+		}
+		if vals[i].Timeout > 0 && !s.set.HasTimeout {
+			return nil, fmt.Errorf("element %v of set %v has timeout but set has no timeout flag: %w", net.IP(element.key), s.set.Name, syscall.EINVAL)
+		}
+	}
+	return ret, nil
+}
+
+func (s *nftablesMemorySet) add(vals []nftables.SetElement, now time.Time) error {
+	elements, err := s.intervals(vals)
+	if err != nil {
+		return err
+	}
+
+	timeouts := make([]time.Duration, 0, len(elements))
+	for _, val := range vals {
+		if !val.IntervalEnd {
+			timeouts = append(timeouts, val.Timeout)
+		}
+	}
+	for i, element := range elements {
+		timeout := timeouts[i]
+		if timeout == 0 && s.set.HasTimeout {
+			timeout = s.set.Timeout
+		}
+		if timeout > 0 {
+			element.expires = now.Add(timeout)
+		}
+
+		// An existing element is kept without NLM_F_EXCL, an overlapped interval is a conflict
+		conflict := false
+		exists := false
+		for key, old := range s.elements {
+			if old.expired(now) {
+				delete(s.elements, key)
+				continue
+			}
+			if bytes.Equal(old.key, element.key) && bytes.Equal(old.end, element.end) {
+				exists = true
+			} else if s.set.Interval && len(old.key) == len(element.key) &&
+				(old.end == nil || bytes.Compare(element.key, old.end) < 0) &&
+				(element.end == nil || bytes.Compare(old.key, element.end) < 0) {
+				conflict = true
+			}
+		}
+		if conflict {
+			return fmt.Errorf("interval %v of set %v conflicts with existing ones: %w", net.IP(element.key), s.set.Name, syscall.EEXIST)
+		}
+		if !exists {
+			s.elements[string(element.key)] = element
+		}
+	}
+	return nil
+}
+
+func (s *nftablesMemorySet) delete(vals []nftables.SetElement, now time.Time) error {
+	elements, err := s.intervals(vals)
+	if err != nil {
+		return err
+	}
+
+	for _, element := range elements {
+		old, ok := s.elements[string(element.key)]
+		if !ok || old.expired(now) || (s.set.Interval && !bytes.Equal(old.end, element.end)) {
+			return fmt.Errorf("element %v of set %v not found: %w", net.IP(element.key), s.set.Name, syscall.ENOENT)
+		}
+		delete(s.elements, string(element.key))
+	}
+	return nil
+}
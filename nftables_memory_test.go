@@ -0,0 +1,111 @@
+package coredns_nftables
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+)
+
+func TestMemoryRuleset(t *testing.T) {
+	ruleset := NewNftablesMemoryRuleset()
+	now := time.Now()
+	ruleset.now = func() time.Time { return now }
+	conn := ruleset.Open()
+
+	table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"})
+	_, direct, _ := net.ParseCIDR("10.0.0.0/8")
+	if err := conn.AddSet(&nftables.Set{Table: table, Name: "direct", KeyType: nftables.TypeIPAddr, Interval: true}, newIntervalElements(direct)); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if err := conn.AddSet(&nftables.Set{Table: table, Name: "proxy", KeyType: nftables.TypeIPAddr, HasTimeout: true, Timeout: time.Minute}, nil); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "direct", net.ParseIP("10.1.2.3")) ||
+		ruleset.Contains(nftables.TableFamilyIPv4, "fw", "direct", net.ParseIP("11.0.0.0")) {
+		t.Fatalf("Unexpected elements of interval set")
+	}
+
+	// Overlapped interval conflicts, and the whole batch is discarded
+	proxy, _ := conn.GetSetByName(table, "proxy")
+	directSet, _ := conn.GetSetByName(table, "direct")
+	_, overlapped, _ := net.ParseCIDR("10.1.0.0/16")
+	conn.SetAddElements(proxy, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}})
+	conn.SetAddElements(directSet, newIntervalElements(overlapped))
+	if err := conn.Flush(); err == nil || ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Expected conflict and discarded batch, but got: %v", err)
+	}
+
+	conn.SetAddElements(proxy, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}})
+	conn.SetAddElements(proxy, []nftables.SetElement{{Key: net.ParseIP("2001:db8::1").To16()}})
+	if err := conn.Flush(); err == nil {
+		t.Fatalf("Expected key type mismatch, but got: %v", err)
+	}
+	conn.SetAddElements(proxy, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}})
+	if err := conn.Flush(); err != nil || !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Expected element added, but got: %v", err)
+	}
+	now = now.Add(2 * time.Minute)
+	if elements, _ := conn.GetSetElements(proxy); len(elements) != 0 {
+		t.Fatalf("Expected element expired, but got: %v", elements)
+	}
+
+	conn.SetDeleteElements(proxy, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}})
+	if err := conn.Flush(); err == nil {
+		t.Fatalf("Expected deleting expired element failed, but got: %v", err)
+	}
+}
+
+func TestMemoryServeWorker(t *testing.T) {
+	ruleset := withMemoryBackend(t)
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		set add element fw direct ip false 1h exclusive-group route
+		set add element fw proxy ip false 1h exclusive-group route priority 10 domain example.org
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	for _, test := range []struct {
+		name   string
+		direct bool
+		proxy  bool
+	}{
+		{"example.net.", true, false},
+		{"www.example.org.", false, true},
+	} {
+		r := new(dns.Msg)
+		r.SetQuestion(test.name, dns.TypeA)
+		r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: test.name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: ip})
+		if _, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1"))); err != nil {
+			t.Fatalf("Expected no errors, but got: %v", err)
+		}
+
+		if ruleset.Contains(nftables.TableFamilyIPv4, "fw", "direct", ip) != test.direct ||
+			ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", ip) != test.proxy {
+			t.Fatalf("Unexpected elements after answer of %v", test.name)
+		}
+	}
+}
+
+// withMemoryBackend makes new caches use an in-memory ruleset, the backend and the cache pool are reset after the test
+func withMemoryBackend(t testing.TB) *NftablesMemoryRuleset {
+	ruleset := NewNftablesMemoryRuleset()
+	SetNftablesBackendFactory(ruleset.Factory())
+	ClearCache()
+	t.Cleanup(func() {
+		SetNftablesBackendFactory(nil)
+		ClearCache()
+	})
+	return ruleset
+}
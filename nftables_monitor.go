@@ -0,0 +1,403 @@
+package coredns_nftables
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/nftables"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+var monitorEnabled bool = false
+
+// monitorReinsert adds the active elements again when their tables or sets are deleted
+var monitorReinsert bool = false
+var monitorRetryInterval time.Duration = time.Second * time.Duration(5)
+
+// monitorGeneration changes when tables or sets are changed by others, pooled caches of older generations are invalidated
+var monitorGeneration atomic.Uint64
+
+// monitorSubscribed is true while events are received, changes are missed when it's false
+var monitorSubscribed atomic.Bool
+
+func SetNftablesMonitor(enabled bool, reinsert bool) {
+	monitorEnabled = enabled
+	monitorReinsert = enabled && reinsert
+}
+
+// NftablesMonitorFactory subscribes to the events of the ruleset, one message of the channel is one generation
+type NftablesMonitorFactory func() (chan *nftables.MonitorEvents, io.Closer, error)
+
+var nftablesMonitorFactory NftablesMonitorFactory = openSystemNFTMonitor
+
+func openSystemNFTMonitor() (chan *nftables.MonitorEvents, io.Closer, error) {
+	c, err := nftables.New()
+	if err != nil {
+		return nil, nil, err
+	}
+	monitor := nftables.NewMonitor(nftables.WithMonitorObject(nftables.MonitorObjectAny))
+	events, err := c.AddGenerationalMonitor(monitor)
+	if err != nil {
+		return nil, nil, err
+	}
+	return events, monitor, nil
+}
+
+// SetNftablesMonitorFactory replaces the subscription of events, nil restores the netlink monitor
+func SetNftablesMonitorFactory(factory NftablesMonitorFactory) {
+	if factory == nil {
+		factory = openSystemNFTMonitor
+	}
+	nftablesMonitorFactory = factory
+}
+
+var monitorLock sync.Mutex = sync.Mutex{}
+var monitorRefs int = 0
+var monitorStop chan struct{}
+
+// monitorDone is closed when the events in handling are done after monitorStop
+var monitorDone chan struct{}
+
+// StartNftablesMonitor subscribes to the events of the ruleset, it's shared by all server blocks
+func StartNftablesMonitor() {
+	monitorLock.Lock()
+	defer monitorLock.Unlock()
+
+	monitorRefs += 1
+	if monitorRefs == 1 {
+		monitorStop = make(chan struct{})
+		monitorDone = make(chan struct{})
+		go runNftablesMonitor(monitorStop, monitorDone)
+	}
+}
+
+// StopNftablesMonitor unsubscribes when the last server block is shutdown, and waits for the events in handling
+func StopNftablesMonitor() {
+	monitorLock.Lock()
+	if monitorRefs == 0 {
+		monitorLock.Unlock()
+		return
+	}
+	monitorRefs -= 1
+	var done chan struct{}
+	if monitorRefs == 0 {
+		close(monitorStop)
+		done = monitorDone
+		monitorStop = nil
+		monitorDone = nil
+	}
+	monitorLock.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+func runNftablesMonitor(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	for {
+		events, closer, err := nftablesMonitorFactory()
+		if err != nil {
+			log.Errorf("Nftables monitor subscribe failed, retry after %v. %v", monitorRetryInterval, err)
+		} else {
+			log.Info("Nftables monitor subscribed")
+			// Changes before the subscription are missed, so caches loaded before it are invalidated
+			monitorGeneration.Add(1)
+			monitorSubscribed.Store(true)
+			watching := watchNftablesMonitor(events, stop)
+			monitorSubscribed.Store(false)
+			closer.Close()
+			if !watching {
+				return
+			}
+			log.Warningf("Nftables monitor closed, subscribe again after %v", monitorRetryInterval)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(monitorRetryInterval):
+		}
+	}
+}
+
+// monitored reports whether changes of the tables of cache are received by the monitor, which only subscribes to
+// the network namespace of CoreDNS
+func (cache *NftablesCache) monitored() bool {
+	return monitorEnabled && monitorSubscribed.Load() && cache.netnsKey == ""
+}
+
+// watchNftablesMonitor handles events until stop, or returns true when the subscription is closed
+func watchNftablesMonitor(events chan *nftables.MonitorEvents, stop chan struct{}) bool {
+	for {
+		select {
+		case <-stop:
+			return false
+		case generation, ok := <-events:
+			if !ok {
+				return true
+			}
+			handleMonitorEvents(generation)
+			if generation.GeneratedBy != nil && generation.GeneratedBy.Type == nftables.MonitorEventTypeOOB {
+				log.Errorf("Nftables monitor receive failed, events may be lost, invalidate all caches. %v", generation.GeneratedBy.Error)
+				invalidateMonitored()
+			}
+		}
+	}
+}
+
+// generatedByCoreDNS reports whether the changes of generation are committed by this process
+func generatedByCoreDNS(generation *nftables.MonitorEvents) bool {
+	if generation.GeneratedBy == nil {
+		return false
+	}
+	gen, ok := generation.GeneratedBy.Data.(*nftables.GenMsg)
+	return ok && int(gen.ProcPID) == os.Getpid()
+}
+
+// handleMonitorEvents invalidates caches by changes of tables and sets in one generation,
+// and adds the active elements of deleted ones again. The events of sets and elements carry no
+// table name, so they match the sets of the same name, or with the same elements, in all tables.
+func handleMonitorEvents(generation *nftables.MonitorEvents) {
+	changed := false
+	deletedTables := make(map[NftablesSetReference]bool)
+	deletedSets := make(map[string]bool)
+	// Elements deleted by others, such as nft flush set, an event without elements may delete any of them
+	foreign := !generatedByCoreDNS(generation)
+	deletedElements := make(map[string]bool)
+	deletedAnyElement := false
+	for _, event := range generation.Changes {
+		if event.Error != nil {
+			continue
+		}
+		switch event.Type {
+		case nftables.MonitorEventTypeNewTable, nftables.MonitorEventTypeNewSet:
+			changed = true
+		case nftables.MonitorEventTypeDelTable:
+			changed = true
+			if table, ok := event.Data.(*nftables.Table); ok {
+				deletedTables[NftablesSetReference{Family: table.Family, TableName: table.Name}] = true
+				invalidateSetSnapshots(func(reference NftablesSetReference) bool {
+					return reference.Family == table.Family && reference.TableName == table.Name
+				})
+			}
+		case nftables.MonitorEventTypeDelSet:
+			changed = true
+			if set, ok := event.Data.(*nftables.Set); ok {
+				deletedSets[set.Name] = true
+				invalidateSetSnapshots(func(reference NftablesSetReference) bool { return reference.SetName == set.Name })
+			}
+		case nftables.MonitorEventTypeDelSetElem:
+			// Additions by others only delay unless-in until the next refresh, but deletions would skip addresses wrongly
+			invalidateSetSnapshots(func(reference NftablesSetReference) bool { return true })
+			if foreign {
+				elements, _ := event.Data.([]nftables.SetElement)
+				deletedAnyElement = deletedAnyElement || len(elements) == 0
+				for _, element := range elements {
+					deletedElements[string(element.Key)] = true
+				}
+			}
+		}
+	}
+
+	if changed {
+		monitorGeneration.Add(1)
+		log.Infof("Nftables monitor found changes of tables or sets, invalidate caches of generation %v", monitorGeneration.Load())
+	}
+	if !monitorReinsert {
+		return
+	}
+	var elementSets map[NftablesSetReference]bool
+	if deletedAnyElement || len(deletedElements) > 0 {
+		elementSets = activeSetsOfElements(func(key []byte) bool { return deletedAnyElement || deletedElements[string(key)] })
+	}
+	if len(deletedTables) > 0 || len(deletedSets) > 0 || len(elementSets) > 0 {
+		reinsertActiveElements(func(reference NftablesSetReference) bool {
+			return deletedSets[reference.SetName] || deletedTables[NftablesSetReference{Family: reference.Family, TableName: reference.TableName}] ||
+				elementSets[reference]
+		})
+	}
+}
+
+// invalidateMonitored invalidates all caches and snapshots when events are lost, and adds all active elements again
+func invalidateMonitored() {
+	monitorGeneration.Add(1)
+	invalidateSetSnapshots(func(reference NftablesSetReference) bool { return true })
+	if monitorReinsert {
+		reinsertActiveElements(func(reference NftablesSetReference) bool { return true })
+	}
+}
+
+func invalidateSetSnapshots(match func(reference NftablesSetReference) bool) {
+	setSnapshotLock.Lock()
+	defer setSnapshotLock.Unlock()
+
+	for reference, snapshot := range setSnapshots {
+		if reference.Netns != "" || !match(reference) {
+			continue
+		}
+		snapshot.lock.Lock()
+		snapshot.refreshTime = time.Time{}
+		snapshot.lock.Unlock()
+	}
+}
+
+// invalidate drops the tables loaded by an older generation
+func (cache *NftablesCache) invalidate(generation uint64) {
+	cache.tables = make(map[nftables.TableFamily]*map[string]*NftableCache)
+	cache.generation = generation
+	for _, child := range cache.namespaces {
+		child.invalidate(generation)
+	}
+}
+
+// nftablesActiveElement is an element added by the plugin, which isn't expired yet
+type nftablesActiveElement struct {
+	elements   []nftables.SetElement
+	isIPv6     bool
+	expireTime time.Time
+}
+
+// nftablesActiveSet is the active elements of a set, and the last rule which adds them
+type nftablesActiveSet struct {
+	rule     *NftablesSetAddElement
+	elements *lru.Cache
+}
+
+var activeElementsLock sync.Mutex = sync.Mutex{}
+var activeElements = make(map[NftablesSetReference]*nftablesActiveSet)
+
+// recordActiveElements keeps the elements added into the namespace of CoreDNS, when they're re-inserted by the monitor
+func (m *NftablesSetAddElement) recordActiveElements(cache *NftablesCache, family nftables.TableFamily, isIPv6 bool, elements []nftables.SetElement, element_text string) {
+	if !monitorReinsert || cache.netnsKey != "" {
+		return
+	}
+
+	expireTime := time.Time{}
+	if m.Timeout > 0 {
+		expireTime = time.Now().Add(m.Timeout)
+	}
+
+	activeElementsLock.Lock()
+	defer activeElementsLock.Unlock()
+
+	reference := NftablesSetReference{Family: family, TableName: m.TableName, SetName: m.SetName}
+	activeSet, ok := activeElements[reference]
+	if !ok {
+		elementCache, _ := lru.New(setLruMaxCount)
+		activeSet = &nftablesActiveSet{elements: elementCache}
+		activeElements[reference] = activeSet
+	}
+	activeSet.rule = m
+	activeSet.elements.Add(element_text, &nftablesActiveElement{elements: elements, isIPv6: isIPv6, expireTime: expireTime})
+}
+
+// forgetActiveElement removes the element deleted by the plugin
+func (m *NftablesSetAddElement) forgetActiveElement(family nftables.TableFamily, element_text string) {
+	activeElementsLock.Lock()
+	defer activeElementsLock.Unlock()
+
+	if activeSet, ok := activeElements[NftablesSetReference{Family: family, TableName: m.TableName, SetName: m.SetName}]; ok {
+		activeSet.elements.Remove(element_text)
+	}
+}
+
+// activeSetsOfElements returns the sets which have active elements of matched keys
+func activeSetsOfElements(match func(key []byte) bool) map[NftablesSetReference]bool {
+	activeElementsLock.Lock()
+	defer activeElementsLock.Unlock()
+
+	ret := make(map[NftablesSetReference]bool)
+	for reference, activeSet := range activeElements {
+		for _, key := range activeSet.elements.Keys() {
+			value, ok := activeSet.elements.Peek(key)
+			if !ok {
+				continue
+			}
+			for _, element := range value.(*nftablesActiveElement).elements {
+				if !element.IntervalEnd && match(element.Key) {
+					ret[reference] = true
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// reinsertActiveElements adds the active elements of matched sets again in one batch,
+// the tables and sets are created as rules do unless in strict mode.
+func reinsertActiveElements(match func(reference NftablesSetReference) bool) {
+	type reinsertion struct {
+		reference NftablesSetReference
+		rule      *NftablesSetAddElement
+		elements  [2][]nftables.SetElement
+	}
+
+	now := time.Now()
+	var reinsertions []reinsertion
+	activeElementsLock.Lock()
+	for reference, activeSet := range activeElements {
+		if !match(reference) {
+			continue
+		}
+		r := reinsertion{reference: reference, rule: activeSet.rule}
+		for _, key := range activeSet.elements.Keys() {
+			value, ok := activeSet.elements.Peek(key)
+			if !ok {
+				continue
+			}
+			element := value.(*nftablesActiveElement)
+			if !element.expireTime.IsZero() && element.expireTime.Before(now) {
+				activeSet.elements.Remove(key)
+				continue
+			}
+			index := 0
+			if element.isIPv6 {
+				index = 1
+			}
+			r.elements[index] = append(r.elements[index], element.elements...)
+		}
+		reinsertions = append(reinsertions, r)
+	}
+	activeElementsLock.Unlock()
+	if len(reinsertions) == 0 {
+		return
+	}
+
+	cache, err := NewCache()
+	if err != nil {
+		log.Errorf("Nftables monitor reinsert elements failed, %v", err)
+		return
+	}
+	defer CloseCache(cache)
+
+	for _, r := range reinsertions {
+		for index, elements := range r.elements {
+			if len(elements) == 0 {
+				continue
+			}
+			text := fmt.Sprintf("%v element(s)", len(elements))
+			if err, _ := r.rule.addElements(context.Background(), cache, r.reference.Family, index == 1, elements, text); err != nil {
+				log.Errorf("Nftables monitor reinsert %v into set %v %v %v failed, %v", text, cache.GetFamilyName(r.reference.Family), r.reference.TableName, r.reference.SetName, err)
+			}
+		}
+	}
+
+	operations := cache.operations
+	failed := cache.Commit()
+	for _, op := range operations {
+		if op.Err != nil {
+			continue
+		}
+		reinsertCount.Add(float64(len(op.Elements)))
+		log.Infof("Nftables monitor reinsert %v into set %v %v %v", op.Text, cache.GetFamilyName(op.Set.Table.Family), op.Set.Table.Name, op.Set.Name)
+	}
+	if len(failed) > 0 {
+		log.Errorf("Nftables monitor reinsert %v of %v operation(s) failed", len(failed), len(operations))
+	}
+}
@@ -0,0 +1,174 @@
+package coredns_nftables
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+func TestMonitorReinsert(t *testing.T) {
+	ruleset := withMemoryBackend(t)
+	events := make(chan *nftables.MonitorEvents)
+	SetNftablesMonitorFactory(func() (chan *nftables.MonitorEvents, io.Closer, error) {
+		return events, io.NopCloser(nil), nil
+	})
+	defer func() {
+		StopNftablesMonitor()
+		SetNftablesMonitor(false, false)
+		SetNftablesMonitorFactory(nil)
+	}()
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		monitor reinsert
+		set add element fw proxy ip false 1h
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if !monitorEnabled || !monitorReinsert {
+		t.Fatalf("Expected monitor with reinsert enabled")
+	}
+	StartNftablesMonitor()
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")})
+	if _, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1"))); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Expected element added")
+	}
+
+	// A reload of the firewall drops the whole ruleset
+	reloaded := NewNftablesMemoryRuleset()
+	SetNftablesBackendFactory(reloaded.Factory())
+	ClearCache()
+	generation := monitorGeneration.Load()
+	events <- &nftables.MonitorEvents{Changes: []*nftables.MonitorEvent{
+		{Type: nftables.MonitorEventTypeDelTable, Data: &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"}},
+		{Type: nftables.MonitorEventTypeNewTable, Data: &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "other"}},
+	}}
+
+	for i := 0; i < 100 && !reloaded.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.1")); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !reloaded.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Expected element inserted again after reload")
+	}
+	if monitorGeneration.Load() == generation {
+		t.Fatalf("Expected generation changed by events")
+	}
+}
+
+func TestMonitorInvalidateCache(t *testing.T) {
+	withMemoryBackend(t)
+
+	cache, err := NewCache()
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	loaded := cache.MutableNftablesTable(nftables.TableFamilyIPv4, "fw")
+	cache.Commit()
+	CloseCache(cache)
+
+	// Element events don't change the generation
+	handleMonitorEvents(&nftables.MonitorEvents{Changes: []*nftables.MonitorEvent{
+		{Type: nftables.MonitorEventTypeNewSetElem, Data: []nftables.SetElement{}},
+	}})
+	if cache, _ = NewCache(); cache.GetNftablesTable(nftables.TableFamilyIPv4, "fw") != loaded {
+		t.Fatalf("Expected cached table kept by element events")
+	}
+	CloseCache(cache)
+
+	handleMonitorEvents(&nftables.MonitorEvents{Changes: []*nftables.MonitorEvent{
+		{Type: nftables.MonitorEventTypeDelTable, Data: &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"}},
+	}})
+	cache, _ = NewCache()
+	defer CloseCache(cache)
+	if reloaded := cache.GetNftablesTable(nftables.TableFamilyIPv4, "fw"); reloaded == nil || reloaded == loaded {
+		t.Fatalf("Expected cached table loaded again after deletion, but got: %v", reloaded)
+	}
+}
+
+func TestMonitorElementEvents(t *testing.T) {
+	ruleset := withMemoryBackend(t)
+	events := make(chan *nftables.MonitorEvents)
+	SetNftablesMonitorFactory(func() (chan *nftables.MonitorEvents, io.Closer, error) {
+		return events, io.NopCloser(nil), nil
+	})
+	defer func() {
+		StopNftablesMonitor()
+		SetNftablesMonitor(false, false)
+		SetNftablesMonitorFactory(nil)
+	}()
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		monitor reinsert
+		set add element fw proxy ip false 1h
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	StartNftablesMonitor()
+
+	ip := net.ParseIP("192.0.2.1")
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: ip})
+	if _, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1"))); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	deleteElement := func() {
+		conn := ruleset.Open()
+		set, _ := conn.GetSetByName(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"}, "proxy")
+		conn.SetDeleteElements(set, []nftables.SetElement{{Key: ip.To4()}})
+		if err := conn.Flush(); err != nil {
+			t.Fatalf("Expected no errors, but got: %v", err)
+		}
+	}
+	deleted := []*nftables.MonitorEvent{{Type: nftables.MonitorEventTypeDelSetElem, Data: []nftables.SetElement{{Key: ip.To4()}}}}
+
+	// Deletions committed by CoreDNS itself are not reverted, the next generation waits for the handling
+	deleteElement()
+	events <- &nftables.MonitorEvents{
+		GeneratedBy: &nftables.MonitorEvent{Type: nftables.MonitorEventType(unix.NFT_MSG_NEWGEN), Data: &nftables.GenMsg{ProcPID: uint32(os.Getpid())}},
+		Changes:     deleted,
+	}
+	events <- &nftables.MonitorEvents{}
+	if ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", ip) {
+		t.Fatalf("Expected element deleted by CoreDNS not inserted again")
+	}
+
+	// nft flush set by others deletes elements
+	events <- &nftables.MonitorEvents{
+		GeneratedBy: &nftables.MonitorEvent{Type: nftables.MonitorEventType(unix.NFT_MSG_NEWGEN), Data: &nftables.GenMsg{ProcPID: uint32(os.Getpid() + 1)}},
+		Changes:     deleted,
+	}
+	events <- &nftables.MonitorEvents{}
+	if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", ip) {
+		t.Fatalf("Expected element deleted by others inserted again")
+	}
+
+	// Lost events invalidate everything
+	deleteElement()
+	generation := monitorGeneration.Load()
+	oob := &nftables.MonitorEvent{Type: nftables.MonitorEventTypeOOB, Error: syscall.ENOBUFS}
+	events <- &nftables.MonitorEvents{GeneratedBy: oob, Changes: []*nftables.MonitorEvent{oob}}
+	events <- &nftables.MonitorEvents{}
+	if monitorGeneration.Load() == generation || !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", ip) {
+		t.Fatalf("Expected caches invalidated and element inserted again after lost events")
+	}
+}
@@ -0,0 +1,126 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// NftablesNetns is the network namespace of a rule, at Path such as /var/run/netns/<name> or of the process Pid
+type NftablesNetns struct {
+	Path string
+	Pid  int
+}
+
+// String returns the key of the namespace, empty means the namespace of CoreDNS
+func (n *NftablesNetns) String() string {
+	if n == nil {
+		return ""
+	}
+	if n.Pid > 0 {
+		return "pid " + strconv.Itoa(n.Pid)
+	}
+	return n.Path
+}
+
+func (n *NftablesNetns) open() (netns.NsHandle, error) {
+	if n.Pid > 0 {
+		return netns.GetFromPid(n.Pid)
+	}
+	return netns.GetFromPath(n.Path)
+}
+
+// parseNetns parses <PATH> or pid <PID>
+func parseNetns(args []string) (*NftablesNetns, error) {
+	if len(args) == 2 && strings.ToLower(args[0]) == "pid" {
+		pid, err := strconv.Atoi(args[1])
+		if err != nil || pid <= 0 {
+			return nil, fmt.Errorf("netns pid %v invalid", args[1])
+		}
+		return &NftablesNetns{Pid: pid}, nil
+	}
+	if len(args) != 1 || !filepath.IsAbs(args[0]) {
+		return nil, fmt.Errorf("netns %v invalid, only netns <PATH> and netns pid <PID> are supported", args)
+	}
+	return &NftablesNetns{Path: args[0]}, nil
+}
+
+// NftablesNetnsBackendFactory opens the connection of a network namespace in the pool
+type NftablesNetnsBackendFactory func(target *NftablesNetns) (NftablesBackend, netns.NsHandle, error)
+
+var nftablesNetnsBackendFactory NftablesNetnsBackendFactory = openSystemNFTBackendOfNetns
+
+func openSystemNFTBackendOfNetns(target *NftablesNetns) (NftablesBackend, netns.NsHandle, error) {
+	ns, err := target.open()
+	if err != nil {
+		return nil, 0, err
+	}
+	c, err := newNetlinkBackend(nftables.WithNetNSFd(int(ns)))
+	if err != nil {
+		log.Errorf("Nftables call nftables.New() of netns %v failed: %v", target.String(), err)
+		cleanupSystemNFTConn(ns)
+		return nil, 0, err
+	}
+	return c, ns, nil
+}
+
+func unsupportedNetnsBackend(target *NftablesNetns) (NftablesBackend, netns.NsHandle, error) {
+	return nil, 0, fmt.Errorf("netns %v is only supported by backend netlink", target.String())
+}
+
+// SetNftablesNetnsBackendFactory replaces the connections of network namespaces, nil restores the netlink connections
+func SetNftablesNetnsBackendFactory(factory NftablesNetnsBackendFactory) {
+	if factory == nil {
+		factory = openSystemNFTBackendOfNetns
+	}
+	nftablesNetnsBackendFactory = factory
+}
+
+// OfNetns returns the cache of the network namespace target, which is pooled and destroyed with cache
+func (cache *NftablesCache) OfNetns(target *NftablesNetns) (*NftablesCache, error) {
+	key := target.String()
+	if key == cache.netnsKey {
+		return cache, nil
+	}
+	if cache.parent != nil {
+		return cache.parent.OfNetns(target)
+	}
+	if ret, ok := cache.namespaces[key]; ok {
+		return ret, nil
+	}
+
+	c, ns, err := nftablesNetnsBackendFactory(target)
+	if err != nil {
+		log.Errorf("Nftables open connection of netns %v failed: %v", key, err)
+		return nil, err
+	}
+
+	geoIPCache := cache.geoIPCache
+	if geoIPCache == nil {
+		geoIPCache, _ = lru.New(setLruMaxCount)
+	}
+	ret := &NftablesCache{
+		tables:            make(map[nftables.TableFamily]*map[string]*NftableCache),
+		geoIPCache:        geoIPCache,
+		CreateTimepoint:   cache.CreateTimepoint,
+		NftableConnection: c,
+		ipsetHeaders:      make(map[string]*netlink.IPSetResult),
+		NetworkNamespace:  ns,
+		netnsKey:          key,
+		netns:             target,
+		parent:            cache,
+		generation:        cache.generation,
+	}
+	if cache.namespaces == nil {
+		cache.namespaces = make(map[string]*NftablesCache)
+	}
+	cache.namespaces[key] = ret
+	log.Infof("Nftables create cache %p of netns %v in pool %p", ret, key, cache)
+	return ret, nil
+}
@@ -0,0 +1,75 @@
+package coredns_nftables
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+	"github.com/vishvananda/netns"
+)
+
+func TestNetnsServeWorker(t *testing.T) {
+	host := withMemoryBackend(t)
+	namespaces := map[string]*NftablesMemoryRuleset{
+		"/var/run/netns/blue": NewNftablesMemoryRuleset(),
+		"pid 1":               NewNftablesMemoryRuleset(),
+	}
+	SetNftablesNetnsBackendFactory(func(target *NftablesNetns) (NftablesBackend, netns.NsHandle, error) {
+		return namespaces[target.String()].Open(), 0, nil
+	})
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		set add element fw host ip false
+	}
+	nftables ip {
+		set add element fw proxy ip false domain example.org
+		set add element fw direct ip false netns pid 1
+		netns /var/run/netns/blue
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: ip})
+	if _, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1"))); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	for _, test := range []struct {
+		ruleset *NftablesMemoryRuleset
+		set     string
+		want    bool
+	}{
+		{host, "host", true},
+		{host, "proxy", false},
+		{namespaces["/var/run/netns/blue"], "proxy", true},
+		{namespaces["/var/run/netns/blue"], "direct", false},
+		{namespaces["pid 1"], "direct", true},
+	} {
+		if test.ruleset.Contains(nftables.TableFamilyIPv4, "fw", test.set, ip) != test.want {
+			t.Fatalf("Expected %v in set %v is %v", ip, test.set, test.want)
+		}
+	}
+
+	for _, config := range []string{
+		`nftables ip {
+			set add element fw proxy ip netns relative/path
+		}`,
+		`nftables ip {
+			ipset add proxy
+			netns pid 1
+		}`,
+	} {
+		c = caddy.NewTestController("dns", config)
+		if err := parse(c, &handle); err == nil {
+			t.Fatalf("Expected errors of %v", config)
+		}
+	}
+}
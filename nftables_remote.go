@@ -0,0 +1,545 @@
+package coredns_nftables
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netns"
+)
+
+var remoteNetwork string
+var remoteAddress string
+var remoteTLSConfig *tls.Config
+var remoteTimeout time.Duration = time.Second * time.Duration(5)
+var remoteRetryTimes int = 3
+var remoteRetryInterval time.Duration = time.Millisecond * time.Duration(200)
+
+// remoteTable, remoteSet and remoteOperation are the messages between the remote backend and the agent
+type remoteTable struct {
+	Family nftables.TableFamily
+	Name   string
+}
+
+type remoteSet struct {
+	Table         remoteTable
+	Name          string
+	KeyType       string
+	KeyBytes      uint32
+	KeyMagic      uint32
+	Interval      bool
+	HasTimeout    bool
+	Timeout       time.Duration
+	Concatenation bool
+	Constant      bool
+	Dynamic       bool
+	Counter       bool
+	Size          uint32
+	Comment       string
+}
+
+type remoteOperation struct {
+	Op       string
+	Table    *remoteTable          `json:",omitempty"`
+	Set      *remoteSet            `json:",omitempty"`
+	Elements []nftables.SetElement `json:",omitempty"`
+}
+
+type remoteRequest struct {
+	ID         uint64
+	Op         string
+	Family     nftables.TableFamily `json:",omitempty"`
+	Set        *remoteSet           `json:",omitempty"`
+	Operations []remoteOperation    `json:",omitempty"`
+}
+
+type remoteResponse struct {
+	ID       uint64
+	Error    string                `json:",omitempty"`
+	Errno    syscall.Errno         `json:",omitempty"`
+	Tables   []remoteTable         `json:",omitempty"`
+	Set      *remoteSet            `json:",omitempty"`
+	Elements []nftables.SetElement `json:",omitempty"`
+}
+
+func newRemoteTable(t *nftables.Table) *remoteTable {
+	return &remoteTable{Family: t.Family, Name: t.Name}
+}
+
+func (t *remoteTable) table() *nftables.Table {
+	return &nftables.Table{Family: t.Family, Name: t.Name}
+}
+
+func newRemoteSet(s *nftables.Set) *remoteSet {
+	return &remoteSet{
+		Table:         *newRemoteTable(s.Table),
+		Name:          s.Name,
+		KeyType:       s.KeyType.Name,
+		KeyBytes:      s.KeyType.Bytes,
+		KeyMagic:      s.KeyType.GetNFTMagic(),
+		Interval:      s.Interval,
+		HasTimeout:    s.HasTimeout,
+		Timeout:       s.Timeout,
+		Concatenation: s.Concatenation,
+		Constant:      s.Constant,
+		Dynamic:       s.Dynamic,
+		Counter:       s.Counter,
+		Size:          s.Size,
+		Comment:       s.Comment,
+	}
+}
+
+func (s *remoteSet) set() *nftables.Set {
+	keyType := nftables.SetDatatype{Name: s.KeyType, Bytes: s.KeyBytes}
+	keyType.SetNFTMagic(s.KeyMagic)
+	return &nftables.Set{
+		Table:         s.Table.table(),
+		Name:          s.Name,
+		KeyType:       keyType,
+		Interval:      s.Interval,
+		HasTimeout:    s.HasTimeout,
+		Timeout:       s.Timeout,
+		Concatenation: s.Concatenation,
+		Constant:      s.Constant,
+		Dynamic:       s.Dynamic,
+		Counter:       s.Counter,
+		Size:          s.Size,
+		Comment:       s.Comment,
+	}
+}
+
+// newRemoteResponseError keeps the errno of err, so the client can check it with errors.Is
+func newRemoteResponseError(response *remoteResponse, err error) {
+	response.Error = err.Error()
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		response.Errno = errno
+	}
+}
+
+func (response *remoteResponse) err() error {
+	if response.Error == "" {
+		return nil
+	}
+	if response.Errno != 0 {
+		return fmt.Errorf("remote: %v: %w", response.Error, response.Errno)
+	}
+	return fmt.Errorf("remote: %v", response.Error)
+}
+
+// parseRemoteAddress parses unix:///path/to/socket or tcp://host:port
+func parseRemoteAddress(address string) (string, string, error) {
+	if path, ok := strings.CutPrefix(address, "unix://"); ok && path != "" {
+		return "unix", path, nil
+	}
+	if host, ok := strings.CutPrefix(address, "tcp://"); ok {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			return "", "", err
+		}
+		return "tcp", host, nil
+	}
+	return "", "", fmt.Errorf("address %v invalid, only unix:// and tcp:// are supported", address)
+}
+
+// NewRemoteTLSConfig loads the certificate of this side and the CA of the other side for mutual TLS
+func NewRemoteTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in %v", caFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// SetRemoteBackend sends modifications of new caches to the agent at address, tlsConfig is only used by tcp://
+func SetRemoteBackend(address string, tlsConfig *tls.Config) error {
+	network, parsedAddress, err := parseRemoteAddress(address)
+	if err != nil {
+		return err
+	}
+	if network == "tcp" && tlsConfig == nil {
+		return fmt.Errorf("%v requires mutual TLS, use tls <CERT> <KEY> <CA>", address)
+	}
+	remoteNetwork = network
+	remoteAddress = parsedAddress
+	remoteTLSConfig = tlsConfig
+	SetNftablesBackendFactory(openRemoteBackend)
+	return nil
+}
+
+// remoteConn queues modifications until Flush like *nftables.Conn, and sends them to the agent in one request
+type remoteConn struct {
+	conn       net.Conn
+	encoder    *json.Encoder
+	decoder    *json.Decoder
+	nextID     uint64
+	operations []remoteOperation
+}
+
+func openRemoteBackend() (NftablesBackend, netns.NsHandle, error) {
+	c := &remoteConn{}
+	if err := c.dial(); err != nil {
+		log.Errorf("Nftables connect to agent %v %v failed: %v", remoteNetwork, remoteAddress, err)
+		return nil, 0, err
+	}
+	return c, 0, nil
+}
+
+func (c *remoteConn) dial() error {
+	dialer := &net.Dialer{Timeout: remoteTimeout}
+	var conn net.Conn
+	var err error
+	if remoteNetwork == "tcp" && remoteTLSConfig != nil {
+		tlsConfig := remoteTLSConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName, _, _ = net.SplitHostPort(remoteAddress)
+		}
+		conn, err = tls.DialWithDialer(dialer, remoteNetwork, remoteAddress, tlsConfig)
+	} else {
+		conn, err = dialer.Dial(remoteNetwork, remoteAddress)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+	c.encoder = json.NewEncoder(conn)
+	c.decoder = json.NewDecoder(bufio.NewReader(conn))
+	return nil
+}
+
+func (c *remoteConn) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// request sends request and waits for its acknowledgement, it reconnects and resends the whole request
+// when the connection is broken. A flush is not idempotent, so it's never resent after it's written,
+// because the agent may have applied it.
+func (c *remoteConn) request(request *remoteRequest) (*remoteResponse, error) {
+	var err error
+	for retry := 0; retry <= remoteRetryTimes; retry++ {
+		if retry > 0 {
+			log.Warningf("Nftables request %v to agent %v %v failed, retry %v. %v", request.Op, remoteNetwork, remoteAddress, retry, err)
+			time.Sleep(remoteRetryInterval * time.Duration(retry))
+		}
+		if c.conn == nil {
+			if err = c.dial(); err != nil {
+				continue
+			}
+		}
+
+		c.nextID += 1
+		request.ID = c.nextID
+		c.conn.SetDeadline(time.Now().Add(remoteTimeout))
+		if err = c.encoder.Encode(request); err != nil {
+			c.close()
+			continue
+		}
+		response := &remoteResponse{}
+		if err = c.decoder.Decode(response); err == nil && response.ID != request.ID {
+			err = fmt.Errorf("acknowledgement %v mismatch request %v", response.ID, request.ID)
+		}
+		if err != nil {
+			c.close()
+			if request.Op == "flush" {
+				return nil, fmt.Errorf("acknowledgement of flush lost, it may be applied by agent: %w", err)
+			}
+			continue
+		}
+		return response, nil
+	}
+	return nil, err
+}
+
+// Close closes the connection to the agent when the cache is destroyed
+func (c *remoteConn) Close() error {
+	c.close()
+	return nil
+}
+
+func (c *remoteConn) ListTablesOfFamily(family nftables.TableFamily) ([]*nftables.Table, error) {
+	response, err := c.request(&remoteRequest{Op: "list-tables", Family: family})
+	if err != nil {
+		return nil, err
+	}
+	if err := response.err(); err != nil {
+		return nil, err
+	}
+
+	var ret []*nftables.Table
+	for _, table := range response.Tables {
+		ret = append(ret, table.table())
+	}
+	return ret, nil
+}
+
+func (c *remoteConn) AddTable(t *nftables.Table) *nftables.Table {
+	c.operations = append(c.operations, remoteOperation{Op: "add-table", Table: newRemoteTable(t)})
+	return t
+}
+
+func (c *remoteConn) GetSetByName(t *nftables.Table, name string) (*nftables.Set, error) {
+	response, err := c.request(&remoteRequest{Op: "get-set", Set: &remoteSet{Table: *newRemoteTable(t), Name: name}})
+	if err != nil {
+		return nil, err
+	}
+	if err := response.err(); err != nil {
+		return nil, err
+	}
+	if response.Set == nil {
+		return nil, fmt.Errorf("set %v %v not found: %w", t.Name, name, syscall.ENOENT)
+	}
+	return response.Set.set(), nil
+}
+
+func (c *remoteConn) AddSet(s *nftables.Set, vals []nftables.SetElement) error {
+	c.operations = append(c.operations, remoteOperation{Op: "add-set", Set: newRemoteSet(s), Elements: vals})
+	return nil
+}
+
+func (c *remoteConn) SetAddElements(s *nftables.Set, vals []nftables.SetElement) error {
+	c.operations = append(c.operations, remoteOperation{Op: "add-elements", Set: newRemoteSet(s), Elements: vals})
+	return nil
+}
+
+func (c *remoteConn) SetDeleteElements(s *nftables.Set, vals []nftables.SetElement) error {
+	c.operations = append(c.operations, remoteOperation{Op: "delete-elements", Set: newRemoteSet(s), Elements: vals})
+	return nil
+}
+
+func (c *remoteConn) GetSetElements(s *nftables.Set) ([]nftables.SetElement, error) {
+	response, err := c.request(&remoteRequest{Op: "get-set-elements", Set: newRemoteSet(s)})
+	if err != nil {
+		return nil, err
+	}
+	return response.Elements, response.err()
+}
+
+// Discard drops the queued modifications
+func (c *remoteConn) Discard() error {
+	c.operations = nil
+	return nil
+}
+
+func (c *remoteConn) Flush() error {
+	operations := c.operations
+	c.operations = nil
+	if len(operations) == 0 {
+		return nil
+	}
+
+	response, err := c.request(&remoteRequest{Op: "flush", Operations: operations})
+	if err != nil {
+		c.close()
+		return err
+	}
+	return response.err()
+}
+
+// NftablesAgent applies the requests of remote backends with the backends of factory
+type NftablesAgent struct {
+	Factory NftablesBackendFactory
+
+	lock      sync.Mutex
+	listeners []net.Listener
+}
+
+// NewNftablesAgent creates an agent with factory, nil uses the backend set by SetNftablesBackendFactory or SetNftCliBackend
+func NewNftablesAgent(factory NftablesBackendFactory) *NftablesAgent {
+	if factory == nil {
+		factory = nftablesBackendFactory
+	}
+	return &NftablesAgent{Factory: factory}
+}
+
+// Listen listens at unix:///path/to/socket or tcp://host:port, tlsConfig is required by tcp://
+func (agent *NftablesAgent) Listen(address string, tlsConfig *tls.Config) (net.Listener, error) {
+	network, parsedAddress, err := parseRemoteAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "tcp" && tlsConfig == nil {
+		return nil, fmt.Errorf("agent of %v requires mutual TLS", address)
+	}
+	if network == "unix" {
+		// Only remove the stale socket of a previous agent
+		if info, err := os.Lstat(parsedAddress); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("%v exists and it's not a socket", parsedAddress)
+			}
+			if err := os.Remove(parsedAddress); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	listener, err := net.Listen(network, parsedAddress)
+	if err != nil {
+		return nil, err
+	}
+	if network == "tcp" {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return listener, nil
+}
+
+// Serve accepts connections until listener is closed
+func (agent *NftablesAgent) Serve(listener net.Listener) error {
+	agent.lock.Lock()
+	agent.listeners = append(agent.listeners, listener)
+	agent.lock.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go agent.serveConn(conn)
+	}
+}
+
+// Close stops all listeners of Serve
+func (agent *NftablesAgent) Close() {
+	agent.lock.Lock()
+	defer agent.lock.Unlock()
+
+	for _, listener := range agent.listeners {
+		listener.Close()
+	}
+	agent.listeners = nil
+}
+
+func (agent *NftablesAgent) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	backend, ns, err := agent.Factory()
+	if err != nil {
+		log.Errorf("Nftables agent open backend for %v failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer func() { closeAgentBackend(backend, ns) }()
+
+	decoder := json.NewDecoder(bufio.NewReader(conn))
+	encoder := json.NewEncoder(conn)
+	for {
+		request := &remoteRequest{}
+		if err := decoder.Decode(request); err != nil {
+			return
+		}
+
+		response := &remoteResponse{ID: request.ID}
+		if err := agent.apply(backend, request, response); err != nil {
+			newRemoteResponseError(response, err)
+			if request.Op == "flush" {
+				// Drop the operations queued before the failure
+				closeAgentBackend(backend, ns)
+				if backend, ns, err = agent.Factory(); err != nil {
+					backend, ns = nil, 0
+					log.Errorf("Nftables agent reopen backend for %v failed: %v", conn.RemoteAddr(), err)
+					encoder.Encode(response)
+					return
+				}
+			}
+		}
+		if err := encoder.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+// closeAgentBackend closes the backend of a connection and its network namespace
+func closeAgentBackend(backend NftablesBackend, ns netns.NsHandle) {
+	if closer, ok := backend.(io.Closer); ok {
+		closer.Close()
+	}
+	cleanupSystemNFTConn(ns)
+}
+
+func (agent *NftablesAgent) apply(backend NftablesBackend, request *remoteRequest, response *remoteResponse) error {
+	switch request.Op {
+	case "list-tables":
+		tables, err := backend.ListTablesOfFamily(request.Family)
+		for _, table := range tables {
+			response.Tables = append(response.Tables, *newRemoteTable(table))
+		}
+		return err
+	case "get-set":
+		if request.Set == nil {
+			return fmt.Errorf("request %v without set: %w", request.Op, syscall.EINVAL)
+		}
+		set, err := backend.GetSetByName(request.Set.Table.table(), request.Set.Name)
+		if set != nil {
+			response.Set = newRemoteSet(set)
+		}
+		return err
+	case "get-set-elements":
+		if request.Set == nil {
+			return fmt.Errorf("request %v without set: %w", request.Op, syscall.EINVAL)
+		}
+		elements, err := backend.GetSetElements(request.Set.set())
+		response.Elements = elements
+		return err
+	case "flush":
+		for _, operation := range request.Operations {
+			if err := agent.queue(backend, &operation); err != nil {
+				return err
+			}
+		}
+		return backend.Flush()
+	}
+	return fmt.Errorf("request %v is not supported: %w", request.Op, syscall.EOPNOTSUPP)
+}
+
+func (agent *NftablesAgent) queue(backend NftablesBackend, operation *remoteOperation) error {
+	if operation.Op == "add-table" {
+		if operation.Table == nil {
+			return fmt.Errorf("operation %v without table: %w", operation.Op, syscall.EINVAL)
+		}
+		backend.AddTable(operation.Table.table())
+		return nil
+	}
+
+	if operation.Set == nil {
+		return fmt.Errorf("operation %v without set: %w", operation.Op, syscall.EINVAL)
+	}
+	switch operation.Op {
+	case "add-set":
+		return backend.AddSet(operation.Set.set(), operation.Elements)
+	case "add-elements":
+		return backend.SetAddElements(operation.Set.set(), operation.Elements)
+	case "delete-elements":
+		return backend.SetDeleteElements(operation.Set.set(), operation.Elements)
+	}
+	return fmt.Errorf("operation %v is not supported: %w", operation.Op, syscall.EOPNOTSUPP)
+}
@@ -0,0 +1,261 @@
+package coredns_nftables
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+	"github.com/vishvananda/netns"
+)
+
+func TestRemoteServeWorker(t *testing.T) {
+	ruleset := withMemoryBackend(t)
+	agent := NewNftablesAgent(ruleset.Factory())
+	address := "unix://" + filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := agent.Listen(address, nil)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	go agent.Serve(listener)
+
+	defer agent.Close()
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		backend remote `+address+`
+		set add element fw proxy ip true 1h domain example.org
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")})
+	if _, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1"))); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Expected element added by agent")
+	}
+
+	// A broken connection is reconnected, and errors of the agent keep their errno
+	backend, _, err := openRemoteBackend()
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	conn := backend.(*remoteConn)
+	conn.conn.Close()
+	table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"}
+	set, err := conn.GetSetByName(table, "proxy")
+	if err != nil || !set.HasTimeout || set.KeyType.Bytes != nftables.TypeIPAddr.Bytes {
+		t.Fatalf("Unexpected set %v after reconnect: %v", set, err)
+	}
+	conn.SetDeleteElements(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.2").To4()}})
+	if err := conn.Flush(); !errors.Is(err, syscall.ENOENT) {
+		t.Fatalf("Expected ENOENT, but got: %v", err)
+	}
+	conn.SetDeleteElements(set, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}})
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Expected element deleted by agent")
+	}
+	conn.Close()
+
+	agent.Close()
+	if _, _, err := openRemoteBackend(); err == nil {
+		t.Fatalf("Expected errors after agent closed")
+	}
+}
+
+// writeRemoteTestCertificates writes a CA and a certificate of 127.0.0.1 signed by it, for both the agent and the client
+func writeRemoteTestCertificates(t *testing.T, dir string) (string, string, string) {
+	writePEM := func(name string, blockType string, bytes []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: bytes}), 0600); err != nil {
+			t.Fatalf("Expected no errors, but got: %v", err)
+		}
+		return path
+	}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "nftables test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	caCertificate, _ := x509.ParseCertificate(caDER)
+	der, err := x509.CreateCertificate(rand.Reader, template, caCertificate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	return writePEM("cert.pem", "CERTIFICATE", der), writePEM("key.pem", "EC PRIVATE KEY", keyDER), writePEM("ca.pem", "CERTIFICATE", caDER)
+}
+
+func TestRemoteTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := writeRemoteTestCertificates(t, dir)
+	tlsConfig, err := NewRemoteTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	ruleset := withMemoryBackend(t)
+	agent := NewNftablesAgent(ruleset.Factory())
+	if _, err := agent.Listen("tcp://127.0.0.1:0", nil); err == nil {
+		t.Fatalf("Expected agent of tcp requires TLS")
+	}
+	listener, err := agent.Listen("tcp://127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	go agent.Serve(listener)
+	defer agent.Close()
+
+	address := "tcp://" + listener.Addr().String()
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		backend remote `+address+`
+	}`)
+	if err := parse(c, &handle); err == nil {
+		t.Fatalf("Expected tcp without tls rejected")
+	}
+	c = caddy.NewTestController("dns", `nftables ip {
+		backend remote `+address+` tls `+certFile+` `+keyFile+` `+caFile+`
+		set add element fw proxy ip false
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")})
+	if _, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1"))); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Expected element added by agent over TLS")
+	}
+
+	// A client without certificate is rejected by the agent
+	remoteTLSConfig = remoteTLSConfig.Clone()
+	remoteTLSConfig.Certificates = nil
+	if backend, _, err := openRemoteBackend(); err == nil {
+		if _, err := backend.ListTablesOfFamily(nftables.TableFamilyIPv4); err == nil {
+			t.Fatalf("Expected client without certificate rejected")
+		}
+		backend.(*remoteConn).Close()
+	}
+}
+
+func TestRemoteListenKeepsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if _, err := NewNftablesAgent(nil).Listen("unix://"+path, nil); err == nil {
+		t.Fatalf("Expected a regular file not replaced by the socket")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "data" {
+		t.Fatalf("Expected the regular file kept, but got: %v, %v", string(data), err)
+	}
+}
+
+// failingFlushBackend fails every Flush, and counts the backends which are not closed yet
+type failingFlushBackend struct {
+	NftablesBackend
+	opened *atomic.Int64
+}
+
+func (b *failingFlushBackend) Flush() error {
+	return errors.New("receive: connection reset")
+}
+
+func (b *failingFlushBackend) Close() error {
+	b.opened.Add(-1)
+	return nil
+}
+
+func TestRemoteAgentFlushErrors(t *testing.T) {
+	ruleset := withMemoryBackend(t)
+	opened := &atomic.Int64{}
+	agent := NewNftablesAgent(func() (NftablesBackend, netns.NsHandle, error) {
+		opened.Add(1)
+		return &failingFlushBackend{NftablesBackend: ruleset.Open(), opened: opened}, 0, nil
+	})
+	address := "unix://" + filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := agent.Listen(address, nil)
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	go agent.Serve(listener)
+	if err := SetRemoteBackend(address, nil); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	defer agent.Close()
+
+	// The backend of a failed flush is closed before another one is opened for the connection
+	backend, _, err := openRemoteBackend()
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	conn := backend.(*remoteConn)
+	table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"})
+	for i := 0; i < 3; i++ {
+		conn.AddSet(&nftables.Set{Table: table, Name: "proxy", KeyType: nftables.TypeIPAddr}, nil)
+		if err := conn.Flush(); err == nil {
+			t.Fatalf("Expected flush errors")
+		}
+		if opened.Load() != 1 {
+			t.Fatalf("Expected one backend opened, but got: %v", opened.Load())
+		}
+	}
+
+	conn.Close()
+	for i := 0; i < 100 && opened.Load() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if opened.Load() != 0 {
+		t.Fatalf("Expected the backend closed with the connection, but got: %v", opened.Load())
+	}
+}
@@ -0,0 +1,97 @@
+package coredns_nftables
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// resolveTarget returns the host name of a MX or NS answer
+func resolveTarget(answer dns.RR) string {
+	switch rr := answer.(type) {
+	case *dns.MX:
+		return rr.Mx
+	case *dns.NS:
+		return rr.Ns
+	}
+	return ""
+}
+
+func (m *NftablesHandler) hasResolveRule(rrtype uint16) bool {
+	for _, ruleSet := range m.Rules {
+		for _, rule := range ruleSet.RuleAddElement {
+			if rule.MatchResolve(rrtype) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lookupAddresses returns the A and AAAA records of name
+func (m *NftablesHandler) lookupAddresses(ctx context.Context, name string) []dns.RR {
+	var ret []dns.RR
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg, err := m.lookup(ctx, name, qtype)
+		if err != nil {
+			log.Warningf("Lookup %v %v failed, %v", dns.TypeToString[qtype], name, err)
+			continue
+		}
+		for _, answer := range msg.Answer {
+			if answer.Header().Rrtype == qtype {
+				ret = append(ret, answer)
+			}
+		}
+	}
+	return ret
+}
+
+// serveResolve resolves the host of a MX or NS answer, and adds its addresses into
+// the sets of rules which resolve this type. resolved caches lookups of one response.
+func (m *NftablesHandler) serveResolve(ctx context.Context, cache *NftablesCache, answer dns.RR, query *NftablesQuery, resolved map[string][]dns.RR) int {
+	target := resolveTarget(answer)
+	if target == "" {
+		return 0
+	}
+
+	addresses, ok := resolved[target]
+	if !ok {
+		addresses = m.lookupAddresses(ctx, target)
+		resolved[target] = addresses
+	}
+
+	applyCounter := 0
+	for _, address := range addresses {
+		tableFamilies := ipv4TableFamilies
+		ip := address.(*dns.A).A
+		if address.Header().Rrtype == dns.TypeAAAA {
+			tableFamilies = ipv6TableFamilies
+			ip = address.(*dns.AAAA).AAAA
+		}
+		if m.isExcludedAddress(ip) {
+			log.Debugf("Ignore ip element %v(%v of %v) because it's excluded", ip.String(), target, answer.Header().Name)
+			continue
+		}
+
+		for _, family := range tableFamilies {
+			ruleSet, ok := m.Rules[family]
+			if !ok {
+				continue
+			}
+			for _, rule := range ruleSet.RuleAddElement {
+				if !rule.MatchResolve(answer.Header().Rrtype) || !rule.Match(ctx, query) {
+					continue
+				}
+
+				err, ignored := rule.ServeDNS(ctx, cache, &address, family)
+				if err != nil {
+					log.Errorf("Add element %v(%v of %v) to %v %v %v failed.%v", address.String(), target, answer.Header().Name, cache.GetFamilyName(family), rule.TableName, rule.SetName, err)
+				} else if !ignored {
+					applyCounter += 1
+				}
+			}
+		}
+	}
+
+	return applyCounter
+}
@@ -0,0 +1,297 @@
+package coredns_nftables
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+var routeExpiryInterval time.Duration = time.Second * time.Duration(10)
+var routeExpiryLock sync.Mutex = sync.Mutex{}
+var routeExpiries = make(map[string]*nftablesRouteExpiry)
+var routeExpiryRefs int = 0
+var routeExpiryStop chan struct{}
+var routeExpiryDone chan struct{}
+
+// NftablesRouteBackend is the part of *netlink.Handle used by route rules
+type NftablesRouteBackend interface {
+	LinkByName(name string) (netlink.Link, error)
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+}
+
+// NftablesRouteBackendFactory opens the rtnetlink connection of a cache when a route rule is served
+type NftablesRouteBackendFactory func() (NftablesRouteBackend, error)
+
+var routeBackendFactory NftablesRouteBackendFactory = openSystemRouteConn
+
+func openSystemRouteConn() (NftablesRouteBackend, error) {
+	handle, err := netlink.NewHandle(unix.NETLINK_ROUTE)
+	if err != nil {
+		log.Errorf("Nftables call netlink.NewHandle() for route failed: %v", err)
+		return nil, err
+	}
+	return handle, nil
+}
+
+// SetRouteBackendFactory replaces the rtnetlink connections of new caches, nil restores the netlink connections
+func SetRouteBackendFactory(factory NftablesRouteBackendFactory) {
+	if factory == nil {
+		factory = openSystemRouteConn
+	}
+	routeBackendFactory = factory
+}
+
+// NftablesRoute installs host routes into a routing table, through Gateway or Device
+type NftablesRoute struct {
+	Table   int
+	Gateway net.IP
+	Device  string
+}
+
+func (r *NftablesRoute) String() string {
+	if r.Gateway != nil {
+		return fmt.Sprintf("table %v via %v", r.Table, r.Gateway)
+	}
+	return fmt.Sprintf("table %v dev %v", r.Table, r.Device)
+}
+
+// nftablesRouteExpiry is an installed route which is removed after ExpireTime
+type nftablesRouteExpiry struct {
+	Route      netlink.Route
+	ExpireTime time.Time
+}
+
+func (cache *NftablesCache) mutableRouteConnection() (NftablesRouteBackend, error) {
+	if cache.RouteConnection == nil {
+		conn, err := routeBackendFactory()
+		if err != nil {
+			return nil, err
+		}
+		cache.RouteConnection = conn
+		cache.routeLinks = make(map[string]int)
+	}
+	return cache.RouteConnection, nil
+}
+
+func (cache *NftablesCache) closeRouteConnection() {
+	if handle, ok := cache.RouteConnection.(*netlink.Handle); ok {
+		handle.Close()
+	}
+	cache.RouteConnection = nil
+}
+
+// routeFailed reopens the rtnetlink connection after its failure, a route rejected by the kernel keeps it.
+// The nftables connection of cache is not affected by either.
+func (cache *NftablesCache) routeFailed(err error) {
+	if !isNftablesOperationError(err) {
+		cache.closeRouteConnection()
+	}
+}
+
+// newRoute returns the host route of ip, or nil if ip doesn't match the family of gateway
+func (cache *NftablesCache) newRoute(r *NftablesRoute, ip net.IP) (*netlink.Route, error) {
+	if r.Gateway != nil && (r.Gateway.To4() == nil) != (ip.To4() == nil) {
+		return nil, nil
+	}
+
+	conn, err := cache.mutableRouteConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	route := &netlink.Route{Dst: hostNetwork(ip), Table: r.Table, Gw: r.Gateway}
+	if ip.To4() != nil {
+		route.Family = unix.AF_INET
+	} else {
+		route.Family = unix.AF_INET6
+	}
+	if r.Device != "" {
+		linkIndex, ok := cache.routeLinks[r.Device]
+		if !ok {
+			link, err := conn.LinkByName(r.Device)
+			if err != nil {
+				return nil, err
+			}
+			linkIndex = link.Attrs().Index
+			cache.routeLinks[r.Device] = linkIndex
+		}
+		route.LinkIndex = linkIndex
+		if r.Gateway == nil {
+			route.Scope = netlink.SCOPE_LINK
+		}
+	}
+	return route, nil
+}
+
+func routeExpiryKey(route *netlink.Route) string {
+	return fmt.Sprintf("%v %v %v %v", route.Table, route.Dst, route.Gw, route.LinkIndex)
+}
+
+// ServeRoute installs the host route of ip, which is removed after Timeout if it's not refreshed by later answers
+func (m *NftablesSetAddElement) ServeRoute(ctx context.Context, cache *NftablesCache, ip net.IP) (error, bool) {
+	route, err := cache.newRoute(m.Route, ip)
+	if err != nil {
+		log.Errorf("Nftables route %v add %v failed. %v", m.Route.String(), ip.String(), err)
+		return err, false
+	}
+	if route == nil {
+		log.Debugf("Nftables route %v ignore %v because family mismatch", m.Route.String(), ip.String())
+		return nil, true
+	}
+
+	log.Debugf("Nftables route %v add %v", m.Route.String(), ip.String())
+	if err := cache.RouteConnection.RouteReplace(route); err != nil {
+		delete(cache.routeLinks, m.Route.Device)
+		cache.routeFailed(err)
+		return err, false
+	}
+
+	if m.Timeout > 0 {
+		routeExpiryLock.Lock()
+		routeExpiries[routeExpiryKey(route)] = &nftablesRouteExpiry{Route: *route, ExpireTime: time.Now().Add(m.Timeout)}
+		routeExpiryLock.Unlock()
+	}
+	return nil, false
+}
+
+// ServeDeleteRoute removes the host route of ip, a missing route is not an error
+func (m *NftablesSetAddElement) ServeDeleteRoute(ctx context.Context, cache *NftablesCache, ip net.IP) error {
+	route, err := cache.newRoute(m.Route, ip)
+	if err != nil || route == nil {
+		return err
+	}
+
+	routeExpiryLock.Lock()
+	delete(routeExpiries, routeExpiryKey(route))
+	routeExpiryLock.Unlock()
+
+	log.Debugf("Nftables route %v delete %v of exclusive group %v", m.Route.String(), ip.String(), m.ExclusiveGroup)
+	if err := deleteRoute(cache.RouteConnection, route); err != nil {
+		cache.routeFailed(err)
+		return err
+	}
+	return nil
+}
+
+func deleteRoute(conn NftablesRouteBackend, route *netlink.Route) error {
+	err := conn.RouteDel(route)
+	if errors.Is(err, unix.ESRCH) || errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+	return err
+}
+
+// expireRoutes removes the routes which are expired at now, and returns the count of them
+func expireRoutes(conn NftablesRouteBackend, now time.Time) int {
+	var expired []*nftablesRouteExpiry
+	routeExpiryLock.Lock()
+	for key, expiry := range routeExpiries {
+		if !expiry.ExpireTime.After(now) {
+			expired = append(expired, expiry)
+			delete(routeExpiries, key)
+		}
+	}
+	routeExpiryLock.Unlock()
+
+	for _, expiry := range expired {
+		if err := deleteRoute(conn, &expiry.Route); err != nil {
+			log.Errorf("Nftables remove expired route %v table %v failed. %v", expiry.Route.Dst, expiry.Route.Table, err)
+		} else {
+			log.Debugf("Nftables remove expired route %v table %v", expiry.Route.Dst, expiry.Route.Table)
+		}
+	}
+	return len(expired)
+}
+
+func hasExpiredRoutes(now time.Time) bool {
+	routeExpiryLock.Lock()
+	defer routeExpiryLock.Unlock()
+
+	for _, expiry := range routeExpiries {
+		if !expiry.ExpireTime.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRouteExpiry reports whether routes of the rules of m are removed after timeout
+func (m *NftablesHandler) hasRouteExpiry() bool {
+	for _, ruleSet := range m.Rules {
+		for _, rule := range ruleSet.RuleAddElement {
+			if rule.Route != nil && rule.Timeout > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StartRouteExpiry removes expired routes in background, it's shared by all server blocks.
+// Routes which are not expired yet are kept by a reload, and removed by the next server blocks.
+func StartRouteExpiry() {
+	routeExpiryLock.Lock()
+	defer routeExpiryLock.Unlock()
+
+	routeExpiryRefs += 1
+	if routeExpiryRefs == 1 {
+		routeExpiryStop = make(chan struct{})
+		routeExpiryDone = make(chan struct{})
+		go runRouteExpiry(routeExpiryStop, routeExpiryDone)
+	}
+}
+
+// StopRouteExpiry stops removing expired routes when the last server block is shutdown,
+// and waits until the background removal exits
+func StopRouteExpiry() {
+	routeExpiryLock.Lock()
+	if routeExpiryRefs == 0 {
+		routeExpiryLock.Unlock()
+		return
+	}
+	routeExpiryRefs -= 1
+	var done chan struct{}
+	if routeExpiryRefs == 0 {
+		close(routeExpiryStop)
+		done = routeExpiryDone
+		routeExpiryStop = nil
+		routeExpiryDone = nil
+	}
+	routeExpiryLock.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+func runRouteExpiry(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(routeExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if !hasExpiredRoutes(time.Now()) {
+			continue
+		}
+
+		conn, err := routeBackendFactory()
+		if err != nil {
+			continue
+		}
+		expireRoutes(conn, time.Now())
+		if handle, ok := conn.(*netlink.Handle); ok {
+			handle.Close()
+		}
+	}
+}
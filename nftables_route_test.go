@@ -0,0 +1,226 @@
+package coredns_nftables
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/miekg/dns"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+type testRouteBackend struct {
+	lock   sync.Mutex
+	routes map[string]netlink.Route
+	// err fails RouteReplace
+	err error
+}
+
+func (b *testRouteBackend) count() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.routes)
+}
+
+func (b *testRouteBackend) LinkByName(name string) (netlink.Link, error) {
+	return &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name, Index: 7}}, nil
+}
+
+func (b *testRouteBackend) RouteReplace(route *netlink.Route) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	b.routes[routeExpiryKey(route)] = *route
+	return nil
+}
+
+func (b *testRouteBackend) RouteDel(route *netlink.Route) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.routes, routeExpiryKey(route))
+	return nil
+}
+
+func TestRouteServeWorker(t *testing.T) {
+	backend := &testRouteBackend{routes: make(map[string]netlink.Route)}
+	withMemoryBackend(t)
+	SetRouteBackendFactory(func() (NftablesRouteBackend, error) { return backend, nil })
+	defer func() {
+		SetRouteBackendFactory(nil)
+		routeExpiries = make(map[string]*nftablesRouteExpiry)
+	}()
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		route add 100 via 192.0.2.254 10m domain example.org
+		route add 200 dev wg0 1s
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("198.51.100.1")})
+	r.Answer = append(r.Answer, &dns.AAAA{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::1")})
+	if _, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1"))); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	// The gateway of table 100 only accepts IPv4 addresses
+	if len(backend.routes) != 3 {
+		t.Fatalf("Expected 3 routes, but got: %v", backend.routes)
+	}
+	for _, route := range backend.routes {
+		if route.Table == 100 && (!route.Gw.Equal(net.ParseIP("192.0.2.254")) || route.Dst.String() != "198.51.100.1/32") {
+			t.Fatalf("Unexpected route %v", route)
+		}
+		if route.Table == 200 && (route.LinkIndex != 7 || route.Scope != netlink.SCOPE_LINK) {
+			t.Fatalf("Unexpected route %v", route)
+		}
+	}
+
+	if count := expireRoutes(backend, time.Now().Add(time.Minute)); count != 2 || len(backend.routes) != 1 {
+		t.Fatalf("Expected routes of table 200 expired, but got: %v %v", count, backend.routes)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		route add 100 10m
+	}`)
+	if err := parse(c, &handle); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+	c = caddy.NewTestController("dns", `nftables ip {
+		route add 0 dev wg0
+	}`)
+	if err := parse(c, &handle); err == nil || !strings.Contains(err.Error(), "positive") {
+		t.Fatalf("Expected table 0 invalid, but got: %v", err)
+	}
+}
+
+func TestRouteErrors(t *testing.T) {
+	backend := &testRouteBackend{routes: make(map[string]netlink.Route)}
+	withMemoryBackend(t)
+	SetRouteBackendFactory(func() (NftablesRouteBackend, error) { return backend, nil })
+	defer SetRouteBackendFactory(nil)
+
+	cache, err := NewCache()
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	defer CloseCache(cache)
+	rule := &NftablesSetAddElement{Route: &NftablesRoute{Table: 100, Device: "wg0"}}
+
+	// A route rejected by the kernel keeps both connections, a failed rtnetlink connection is reopened alone
+	backend.err = unix.EEXIST
+	if err, _ := rule.ServeRoute(context.Background(), cache, net.ParseIP("192.0.2.1")); err == nil || cache.RouteConnection == nil || cache.HasNftableConnectionError {
+		t.Fatalf("Expected the rejected route keeps connections, but got: %v, %v", err, cache.HasNftableConnectionError)
+	}
+	backend.err = errors.New("receive: connection reset")
+	if err, _ := rule.ServeRoute(context.Background(), cache, net.ParseIP("192.0.2.1")); err == nil || cache.RouteConnection != nil || cache.HasNftableConnectionError {
+		t.Fatalf("Expected only the rtnetlink connection closed, but got: %v, %v", err, cache.HasNftableConnectionError)
+	}
+	backend.err = nil
+	if err, _ := rule.ServeRoute(context.Background(), cache, net.ParseIP("192.0.2.1")); err != nil || backend.count() != 1 {
+		t.Fatalf("Expected the route installed by a new connection, but got: %v, %v", err, backend.routes)
+	}
+}
+
+func TestRouteExpiryLifecycle(t *testing.T) {
+	backend := &testRouteBackend{routes: make(map[string]netlink.Route)}
+	SetRouteBackendFactory(func() (NftablesRouteBackend, error) { return backend, nil })
+	routeExpiryInterval = 10 * time.Millisecond
+	defer func() {
+		SetRouteBackendFactory(nil)
+		routeExpiryInterval = 10 * time.Second
+		routeExpiries = make(map[string]*nftablesRouteExpiry)
+	}()
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		route add 200 dev wg0 1s
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if !handle.hasRouteExpiry() {
+		t.Fatalf("Expected routes with timeout expired in background")
+	}
+
+	route := &netlink.Route{Dst: hostNetwork(net.ParseIP("198.51.100.1")), Table: 200, LinkIndex: 7}
+	backend.RouteReplace(route)
+	routeExpiryLock.Lock()
+	routeExpiries[routeExpiryKey(route)] = &nftablesRouteExpiry{Route: *route, ExpireTime: time.Now()}
+	routeExpiryLock.Unlock()
+
+	// Both server blocks share the goroutine, which stops with the last one
+	StartRouteExpiry()
+	StartRouteExpiry()
+	for i := 0; i < 100 && backend.count() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if backend.count() != 0 {
+		t.Fatalf("Expected expired route removed, but got: %v", backend.routes)
+	}
+	StopRouteExpiry()
+	if routeExpiryStop == nil {
+		t.Fatalf("Expected route expiry running for the other server block")
+	}
+	StopRouteExpiry()
+	if routeExpiryStop != nil || routeExpiryRefs != 0 {
+		t.Fatalf("Expected route expiry stopped")
+	}
+}
+
+func TestRouteConcurrentServeWorker(t *testing.T) {
+	backend := &testRouteBackend{routes: make(map[string]netlink.Route)}
+	withMemoryBackend(t)
+	SetRouteBackendFactory(func() (NftablesRouteBackend, error) { return backend, nil })
+	defer func() {
+		SetRouteBackendFactory(nil)
+		routeExpiries = make(map[string]*nftablesRouteExpiry)
+	}()
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		route add 200 dev wg0 1h
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	// Requests record expiries while expired routes are removed
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			r := new(dns.Msg)
+			r.SetQuestion("example.org.", dns.TypeA)
+			r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(198, 51, 100, byte(i))})
+			if _, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1"))); err != nil {
+				t.Errorf("Expected no errors, but got: %v", err)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			expireRoutes(backend, time.Now())
+		}()
+	}
+	wg.Wait()
+
+	routeExpiryLock.Lock()
+	expiries := len(routeExpiries)
+	routeExpiryLock.Unlock()
+	if expiries != 16 || backend.count() != 16 {
+		t.Fatalf("Expected 16 routes with expiries, but got: %v, %v", expiries, backend.count())
+	}
+}
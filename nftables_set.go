@@ -2,8 +2,14 @@ package coredns_nftables
 
 import (
 	"context"
+	"net"
+	"slices"
+	"strconv"
 	"time"
 
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/metrics"
 	"github.com/google/nftables"
 	"github.com/miekg/dns"
 )
@@ -14,27 +20,239 @@ type NftablesSetAddElement struct {
 	Interval  bool
 	Timeout   time.Duration
 	KeyType   nftables.SetDatatype
+	// Domains is the domain selector of this rule, empty means all domains
+	Domains []string
+	// Resolve contains MX and/or NS, whose hosts are resolved and added into the set
+	Resolve []uint16
+	// Clients limits this rule to queries from these networks, empty means all clients
+	Clients []*net.IPNet
+	// QTypes limits this rule to these query types, empty means all types
+	QTypes []uint16
+	// Rcodes limits this rule to responses of these codes, empty means all codes
+	Rcodes []int
+	// RequireValidated only accepts responses with the AD bit, or marked by ValidatedMetadata
+	RequireValidated  bool
+	ValidatedMetadata string
+	// Excludes are the addresses which are never added by this rule
+	Excludes []*net.IPNet
+	// GeoIPFilter selects addresses by the databases of GeoIP
+	GeoIPFilter NftablesGeoIPFilter
+	GeoIP       *NftablesGeoIP
+	// UnlessIn skips addresses which are already in these sets of the same family
+	UnlessIn []NftablesSetReference
+	// ExclusiveGroup names the group whose sets never contain the same address,
+	// the matched rule of the highest Priority wins
+	ExclusiveGroup string
+	Priority       int
+	// IPSet adds elements into the ipset SetName instead of a nftables set, Interval means hash:net
+	IPSet   bool
+	Comment string
+	// Route installs host routes instead of adding elements into a set
+	Route *NftablesRoute
+	// Netns is the network namespace of the set, nil means the namespace of CoreDNS
+	Netns *NftablesNetns
 }
 
 func (m *NftablesSetAddElement) Name() string { return "nftables-set-add-element" }
 
+// MatchDomain reports whether name is one of Domains or a subdomain of them.
+func (m *NftablesSetAddElement) MatchDomain(name string) bool {
+	if len(m.Domains) == 0 {
+		return true
+	}
+
+	for _, domain := range m.Domains {
+		if plugin.Name(domain).Matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchClient reports whether the client network is inside one of Clients.
+func (m *NftablesSetAddElement) MatchClient(client *net.IPNet) bool {
+	if len(m.Clients) == 0 {
+		return true
+	}
+	if client == nil {
+		return false
+	}
+
+	clientOnes, clientBits := client.Mask.Size()
+	for _, network := range m.Clients {
+		ones, bits := network.Mask.Size()
+		if bits == clientBits && ones <= clientOnes && network.Contains(client.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchResponse reports whether the query type and response code of query are selected by this rule.
+func (m *NftablesSetAddElement) MatchResponse(query *NftablesQuery) bool {
+	if len(m.QTypes) > 0 && !slices.Contains(m.QTypes, query.QType) {
+		return false
+	}
+	if len(m.Rcodes) > 0 && !slices.Contains(m.Rcodes, query.Rcode) {
+		return false
+	}
+	return true
+}
+
+// MatchValidated reports whether query is validated by DNSSEC when this rule requires it.
+// Rejected queries are counted and logged once per rule.
+func (m *NftablesSetAddElement) MatchValidated(ctx context.Context, query *NftablesQuery) bool {
+	if !m.RequireValidated || query.AuthenticatedData {
+		return true
+	}
+
+	if m.ValidatedMetadata != "" {
+		if value := metadata.ValueFunc(ctx, m.ValidatedMetadata); value != nil {
+			if validated, _ := strconv.ParseBool(value()); validated {
+				return true
+			}
+		}
+	}
+
+	if query.unvalidatedRules != nil {
+		if query.unvalidatedRules[m] {
+			return false
+		}
+		query.unvalidatedRules[m] = true
+	}
+	unvalidatedCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+	log.Warningf("Nftables set %v %v reject %v because the response is not validated", m.TableName, m.SetName, query.Name)
+	return false
+}
+
+// Match reports whether query is selected by this rule.
+func (m *NftablesSetAddElement) Match(ctx context.Context, query *NftablesQuery) bool {
+	return m.MatchResponse(query) && m.MatchDomain(query.Name) && m.MatchClient(query.Client) && m.MatchValidated(ctx, query)
+}
+
+// MatchAddress reports whether ip is selected by exclude-cidr, GeoIP and unless-in filters of this rule
+func (m *NftablesSetAddElement) MatchAddress(cache *NftablesCache, family nftables.TableFamily, ip net.IP) bool {
+	if networksContain(m.Excludes, ip) {
+		return false
+	}
+
+	if m.GeoIP != nil && (m.GeoIPFilter.HasCountry() || m.GeoIPFilter.HasASN()) {
+		country, asn := cache.LookupGeoIP(m.GeoIP, ip)
+		if !m.GeoIPFilter.Match(country, asn) {
+			return false
+		}
+	}
+
+	if len(m.UnlessIn) > 0 {
+		netnsCache, err := cache.OfNetns(m.Netns)
+		if err != nil {
+			return false
+		}
+		cache = netnsCache
+	}
+	for _, reference := range m.UnlessIn {
+		reference.Family = family
+		reference.Netns = cache.netnsKey
+		if cache.SetSnapshotContains(reference, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchResolve reports whether hosts of rrtype answers should be resolved by this rule
+func (m *NftablesSetAddElement) MatchResolve(rrtype uint16) bool {
+	for _, resolve := range m.Resolve {
+		if resolve == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *NftablesSetAddElement) ServeDNS(ctx context.Context, cache *NftablesCache, answer *dns.RR, family nftables.TableFamily) (error, bool) {
-	var elements []nftables.SetElement
-	var element_text string
 	switch (*answer).Header().Rrtype {
 	case dns.TypeA:
-		elements = []nftables.SetElement{{Key: (*answer).(*dns.A).A}}
-		element_text = (*answer).(*dns.A).A.String()
+		return m.ServeIP(ctx, cache, (*answer).(*dns.A).A, family)
 	case dns.TypeAAAA:
-		elements = []nftables.SetElement{{Key: (*answer).(*dns.AAAA).AAAA}}
-		element_text = (*answer).(*dns.AAAA).AAAA.String()
+		return m.ServeIP(ctx, cache, (*answer).(*dns.AAAA).AAAA, family)
 	default:
 		return nil, true
 	}
+}
+
+// ServeIP adds a single address into the set
+func (m *NftablesSetAddElement) ServeIP(ctx context.Context, cache *NftablesCache, ip net.IP, family nftables.TableFamily) (error, bool) {
+	cache, err := cache.OfNetns(m.Netns)
+	if err != nil {
+		return err, false
+	}
+	if !m.MatchAddress(cache, family, ip) {
+		log.Debugf("Nftables set %v %v %v ignore element %s because it's excluded or filtered", cache.GetFamilyName(family), m.TableName, m.SetName, ip.String())
+		return nil, true
+	}
+	if m.IPSet {
+		return m.ServeIPSet(ctx, cache, hostNetwork(ip))
+	}
+	if m.Route != nil {
+		return m.ServeRoute(ctx, cache, ip)
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return m.addActiveElements(ctx, cache, family, false, []nftables.SetElement{{Key: ipv4, Comment: m.Comment}}, ipv4.String())
+	}
+	return m.addActiveElements(ctx, cache, family, true, []nftables.SetElement{{Key: ip.To16(), Comment: m.Comment}}, ip.String())
+}
+
+// ServeCIDR adds the whole network into the set as an interval
+func (m *NftablesSetAddElement) ServeCIDR(ctx context.Context, cache *NftablesCache, network *net.IPNet, family nftables.TableFamily) (error, bool) {
+	cache, err := cache.OfNetns(m.Netns)
+	if err != nil {
+		return err, false
+	}
+	if !m.MatchAddress(cache, family, network.IP) {
+		log.Debugf("Nftables set %v %v %v ignore element %s because it's excluded or filtered", cache.GetFamilyName(family), m.TableName, m.SetName, network.String())
+		return nil, true
+	}
+	if m.IPSet {
+		return m.ServeIPSet(ctx, cache, network)
+	}
+	if m.Route != nil {
+		log.Debugf("Nftables route %v ignore %s because only host routes are installed", m.Route.String(), network.String())
+		return nil, true
+	}
+	isIPv6 := network.IP.To4() == nil
+	elements := newIntervalElements(network)
+	elements[0].Comment = m.Comment
+	return m.addActiveElements(ctx, cache, family, isIPv6, elements, network.String())
+}
 
-	tableCache := cache.MutableNftablesTable(family, m.TableName)
+// addActiveElements adds elements, and records them for the monitor when they're added
+func (m *NftablesSetAddElement) addActiveElements(ctx context.Context, cache *NftablesCache, family nftables.TableFamily, isIPv6 bool, elements []nftables.SetElement, element_text string) (error, bool) {
+	err, ignored := m.addElements(ctx, cache, family, isIPv6, elements, element_text)
+	if err == nil && !ignored {
+		m.recordActiveElements(cache, family, isIPv6, elements, element_text)
+	}
+	return err, ignored
+}
+
+func (m *NftablesSetAddElement) addElements(ctx context.Context, cache *NftablesCache, family nftables.TableFamily, isIPv6 bool, elements []nftables.SetElement, element_text string) (error, bool) {
+	var tableCache *NftableCache
+	if strictMode {
+		if tableCache = cache.GetNftablesTable(family, m.TableName); tableCache == nil {
+			err := errStrictNotFound("table "+(*cache).GetFamilyName(family), m.TableName)
+			log.Errorf("Nftables set %v %v %v add element %s failed. %v", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text, err)
+			return err, false
+		}
+	} else {
+		tableCache = cache.MutableNftablesTable(family, m.TableName)
+	}
 	// get old set
-	set, _ := cache.NftableConnection.GetSetByName(tableCache.table, m.SetName)
+	set, _ := cache.GetSet(tableCache, m.SetName)
+	if set == nil && strictMode {
+		err := errStrictNotFound("set "+(*cache).GetFamilyName(family)+" "+m.TableName, m.SetName)
+		log.Errorf("Nftables set %v %v %v add element %s failed. %v", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text, err)
+		return err, false
+	}
 	if set == nil {
 		// Create nftable set if KeyType is not nftables.TypeInvalid
 		var keyType = m.KeyType
@@ -51,10 +269,10 @@ func (m *NftablesSetAddElement) ServeDNS(ctx context.Context, cache *NftablesCac
 		}
 
 		// Ignore unmatched set
-		if (*answer).Header().Rrtype == dns.TypeA && keyType == nftables.TypeIP6Addr {
+		if !isIPv6 && keyType == nftables.TypeIP6Addr {
 			log.Debugf("Nftables set %v %v %v ignore element %s because it's a ipv6 set", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text)
 			return nil, true
-		} else if (*answer).Header().Rrtype == dns.TypeAAAA && keyType == nftables.TypeIPAddr {
+		} else if isIPv6 && keyType == nftables.TypeIPAddr {
 			log.Debugf("Nftables set %v %v %v ignore element %s because it's a ipv4 set", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text)
 			return nil, true
 		}
@@ -69,27 +287,47 @@ func (m *NftablesSetAddElement) ServeDNS(ctx context.Context, cache *NftablesCac
 		}
 
 		log.Debugf("Nftables create set %v %v %v and add element %s", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text)
-		err := cache.NftableConnection.AddSet(portSet, elements)
-		if err != nil {
-			log.Errorf("Nftables create set %v %v %v and add element %s but AddSet failed. %v", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text, err)
-			return err, false
-		}
-		err = cache.NftableConnection.Flush()
-		if err != nil {
-			log.Errorf("Nftables create set %v %v %v and add element %s but Flush failed. %v", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text, err)
-			cache.HasNftableConnectionError = true
-		}
-		return err, false
+		cache.queueOperation(&NftablesOperation{CreateSet: true, Set: portSet, Elements: elements, Text: element_text, counted: true})
+		return nil, false
 	}
 
 	// Ignore unmatched set
-	if (*answer).Header().Rrtype == dns.TypeA && set.KeyType == nftables.TypeIP6Addr {
+	if !isIPv6 && set.KeyType == nftables.TypeIP6Addr {
 		log.Debugf("Nftables set %v %v %v ignore element %s because it's a ipv6 set", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text)
 		return nil, true
-	} else if (*answer).Header().Rrtype == dns.TypeAAAA && set.KeyType == nftables.TypeIPAddr {
+	} else if isIPv6 && set.KeyType == nftables.TypeIPAddr {
 		log.Debugf("Nftables set %v %v %v ignore element %s because it's a ipv4 set", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text)
 		return nil, true
 	}
 	log.Debugf("Nftables set %v %v %v add element %s", (*cache).GetFamilyName(family), m.TableName, m.SetName, element_text)
-	return cache.SetAddElements(tableCache, set, elements), false
+	cache.queueOperation(&NftablesOperation{Set: set, Elements: elements, Text: element_text, counted: true})
+	return nil, false
+}
+
+// newIntervalElements returns the elements of an interval set which cover network
+func newIntervalElements(network *net.IPNet) []nftables.SetElement {
+	start := network.IP.To4()
+	if start == nil {
+		start = network.IP.To16()
+	}
+	mask := network.Mask
+	if len(mask) > len(start) {
+		mask = mask[len(mask)-len(start):]
+	}
+	start = start.Mask(mask)
+
+	end := make(net.IP, len(start))
+	copy(end, start)
+	for i := range end {
+		end[i] |= ^mask[i]
+	}
+	// The interval end is exclusive, there is no end element when the network reaches the last address
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i] += 1
+		if end[i] != 0 {
+			return []nftables.SetElement{{Key: start}, {Key: end, IntervalEnd: true}}
+		}
+	}
+
+	return []nftables.SetElement{{Key: start}}
 }
@@ -0,0 +1,228 @@
+package coredns_nftables
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+var setSnapshotInterval time.Duration = time.Minute
+var setSnapshotLock sync.Mutex = sync.Mutex{}
+var setSnapshots = make(map[NftablesSetReference]*nftablesSetSnapshot)
+
+// NftablesSetReference names a set in kernel
+type NftablesSetReference struct {
+	Family    nftables.TableFamily
+	TableName string
+	SetName   string
+	// Netns is the key of the network namespace, empty means the namespace of CoreDNS
+	Netns string
+}
+
+type nftablesAddressRange struct {
+	start []byte
+	// end is exclusive, nil means the range reaches the last address
+	end []byte
+}
+
+// nftablesSetSnapshot is a local copy of the elements of a kernel set, ranges are sorted by start
+type nftablesSetSnapshot struct {
+	lock sync.RWMutex
+	// loadLock makes queries wait for the first load
+	loadLock sync.Mutex
+	// netns is the network namespace of the set, which is opened again by the refresh in background
+	netns       *NftablesNetns
+	loaded      bool
+	refreshing  bool
+	refreshTime time.Time
+	addresses   map[string]bool
+	ranges      []nftablesAddressRange
+}
+
+// contains reports whether key is in the snapshot, the caller must hold the read lock
+func (snapshot *nftablesSetSnapshot) contains(key []byte) bool {
+	if snapshot.addresses[string(key)] {
+		return true
+	}
+
+	// The last range which starts before key is the only one which may contain it
+	index := sort.Search(len(snapshot.ranges), func(i int) bool {
+		return bytes.Compare(snapshot.ranges[i].start, key) > 0
+	}) - 1
+	if index < 0 {
+		return false
+	}
+	r := snapshot.ranges[index]
+	return len(r.start) == len(key) && (r.end == nil || bytes.Compare(key, r.end) < 0)
+}
+
+// refresh replaces the elements by the ones of set. Interval sets are dumped as sorted start and end elements,
+// and concatenated ranges use KeyEnd which is inclusive.
+func (snapshot *nftablesSetSnapshot) refresh(set *nftables.Set, elements []nftables.SetElement) {
+	addresses := make(map[string]bool)
+	var ranges []nftablesAddressRange
+	defer func() {
+		sort.Slice(ranges, func(i, j int) bool {
+			return bytes.Compare(ranges[i].start, ranges[j].start) < 0
+		})
+		snapshot.lock.Lock()
+		snapshot.addresses = addresses
+		snapshot.ranges = ranges
+		snapshot.loaded = true
+		snapshot.refreshTime = time.Now()
+		snapshot.lock.Unlock()
+	}()
+
+	if !set.Interval {
+		for _, element := range elements {
+			addresses[string(element.Key)] = true
+		}
+		return
+	}
+
+	// The end of an interval goes before the start of the next one with the same key
+	sort.SliceStable(elements, func(i, j int) bool {
+		if compare := bytes.Compare(elements[i].Key, elements[j].Key); compare != 0 {
+			return compare < 0
+		}
+		return elements[i].IntervalEnd && !elements[j].IntervalEnd
+	})
+	var start []byte
+	for _, element := range elements {
+		if len(element.KeyEnd) > 0 {
+			end := nextAddress(element.KeyEnd)
+			ranges = append(ranges, nftablesAddressRange{start: element.Key, end: end})
+			continue
+		}
+
+		if element.IntervalEnd {
+			if start != nil {
+				ranges = append(ranges, nftablesAddressRange{start: start, end: element.Key})
+				start = nil
+			}
+			continue
+		}
+
+		if start != nil {
+			// An interval without end element reaches the last address
+			ranges = append(ranges, nftablesAddressRange{start: start})
+		}
+		start = element.Key
+	}
+	if start != nil {
+		ranges = append(ranges, nftablesAddressRange{start: start})
+	}
+}
+
+// nextAddress returns the address after key, or nil if key is the last address
+func nextAddress(key []byte) []byte {
+	ret := make([]byte, len(key))
+	copy(ret, key)
+	for i := len(ret) - 1; i >= 0; i-- {
+		ret[i] += 1
+		if ret[i] != 0 {
+			return ret
+		}
+	}
+	return nil
+}
+
+// load refreshes the snapshot by the set of reference in the connection of cache
+func (snapshot *nftablesSetSnapshot) load(cache *NftablesCache, reference NftablesSetReference) {
+	var set *nftables.Set
+	var err error
+	if tableCache := cache.GetNftablesTable(reference.Family, reference.TableName); tableCache != nil {
+		set, err = cache.NftableConnection.GetSetByName(tableCache.table, reference.SetName)
+	}
+	if err != nil || set == nil {
+		log.Debugf("Nftables snapshot of set %v %v %v not found, %v", cache.GetFamilyName(reference.Family), reference.TableName, reference.SetName, err)
+		snapshot.refresh(&nftables.Set{}, nil)
+	} else if elements, err := cache.NftableConnection.GetSetElements(set); err != nil {
+		log.Errorf("Nftables snapshot of set %v %v %v failed, %v", cache.GetFamilyName(reference.Family), reference.TableName, reference.SetName, err)
+		// Keep the old elements until the next interval
+		snapshot.lock.Lock()
+		snapshot.loaded = true
+		snapshot.refreshTime = time.Now()
+		snapshot.lock.Unlock()
+	} else {
+		snapshot.refresh(set, elements)
+		log.Debugf("Nftables snapshot of set %v %v %v refreshed with %v element(s)", cache.GetFamilyName(reference.Family), reference.TableName, reference.SetName, len(elements))
+	}
+}
+
+// refreshInBackground loads the snapshot by another pooled connection, the old elements are used until it's done
+func (snapshot *nftablesSetSnapshot) refreshInBackground(reference NftablesSetReference) {
+	defer func() {
+		snapshot.lock.Lock()
+		snapshot.refreshing = false
+		snapshot.lock.Unlock()
+	}()
+
+	cache, err := NewCache()
+	if err != nil {
+		log.Errorf("Nftables snapshot of set %v %v failed, %v", reference.TableName, reference.SetName, err)
+		return
+	}
+	defer CloseCache(cache)
+	netnsCache, err := cache.OfNetns(snapshot.netns)
+	if err != nil {
+		return
+	}
+	snapshot.load(netnsCache, reference)
+}
+
+// startRefresh reports whether the caller should refresh the stale snapshot, only one refresh runs at a time
+func (snapshot *nftablesSetSnapshot) startRefresh() bool {
+	snapshot.lock.Lock()
+	defer snapshot.lock.Unlock()
+
+	if snapshot.refreshing || time.Since(snapshot.refreshTime) <= setSnapshotInterval {
+		return false
+	}
+	snapshot.refreshing = true
+	return true
+}
+
+// SetSnapshotContains reports whether ip is in the local snapshot of a kernel set. The snapshot is loaded by this
+// connection for the first time, and refreshed in background when it's older than setSnapshotInterval.
+func (cache *NftablesCache) SetSnapshotContains(reference NftablesSetReference, ip net.IP) bool {
+	setSnapshotLock.Lock()
+	snapshot, ok := setSnapshots[reference]
+	if !ok {
+		snapshot = &nftablesSetSnapshot{netns: cache.netns}
+		setSnapshots[reference] = snapshot
+	}
+	setSnapshotLock.Unlock()
+
+	snapshot.lock.RLock()
+	loaded := snapshot.loaded
+	snapshot.lock.RUnlock()
+	if !loaded {
+		// Queries wait for the first load, so an existing set is never seen empty
+		snapshot.loadLock.Lock()
+		snapshot.lock.RLock()
+		loaded = snapshot.loaded
+		snapshot.lock.RUnlock()
+		if !loaded {
+			snapshot.load(cache, reference)
+		}
+		snapshot.loadLock.Unlock()
+	} else if snapshot.startRefresh() {
+		go snapshot.refreshInBackground(reference)
+	}
+
+	snapshot.lock.RLock()
+	defer snapshot.lock.RUnlock()
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return snapshot.contains(ipv4)
+	}
+	return snapshot.contains(ip.To16())
+}
+
+func SetSetSnapshotInterval(interval time.Duration) {
+	setSnapshotInterval = interval
+}
@@ -0,0 +1,93 @@
+package coredns_nftables
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+func TestSetSnapshotIntervals(t *testing.T) {
+	_, direct, _ := net.ParseCIDR("10.0.0.0/8")
+	_, adjacent, _ := net.ParseCIDR("11.0.0.0/8")
+	elements := append(newIntervalElements(adjacent), newIntervalElements(direct)...)
+	elements = append(elements, nftables.SetElement{Key: net.ParseIP("0.0.0.0").To4(), IntervalEnd: true})
+
+	snapshot := &nftablesSetSnapshot{}
+	snapshot.refresh(&nftables.Set{Interval: true}, elements)
+	for _, ip := range []string{"10.0.0.1", "10.255.255.255", "11.1.2.3"} {
+		if !snapshot.contains(net.ParseIP(ip).To4()) {
+			t.Fatalf("Expected %v in snapshot %v", ip, snapshot.ranges)
+		}
+	}
+	for _, ip := range []string{"9.255.255.255", "12.0.0.0", "0.0.0.0"} {
+		if snapshot.contains(net.ParseIP(ip).To4()) {
+			t.Fatalf("Expected %v not in snapshot %v", ip, snapshot.ranges)
+		}
+	}
+
+	snapshot.refresh(&nftables.Set{}, []nftables.SetElement{{Key: net.ParseIP("192.0.2.1").To4()}})
+	if !snapshot.contains(net.ParseIP("192.0.2.1").To4()) || snapshot.contains(net.ParseIP("192.0.2.2").To4()) {
+		t.Fatalf("Unexpected snapshot %v", snapshot.addresses)
+	}
+}
+
+func TestSetSnapshotRefreshInBackground(t *testing.T) {
+	ruleset := withMemoryBackend(t)
+	conn := ruleset.Open()
+	table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"})
+	direct := &nftables.Set{Table: table, Name: "direct", KeyType: nftables.TypeIPAddr, Interval: true}
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	conn.AddSet(direct, newIntervalElements(network))
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	setSnapshotLock.Lock()
+	setSnapshots = make(map[NftablesSetReference]*nftablesSetSnapshot)
+	setSnapshotLock.Unlock()
+	defer func() {
+		SetSetSnapshotInterval(time.Minute)
+		setSnapshotLock.Lock()
+		setSnapshots = make(map[NftablesSetReference]*nftablesSetSnapshot)
+		setSnapshotLock.Unlock()
+	}()
+
+	cache, _ := NewCache()
+	defer CloseCache(cache)
+	reference := NftablesSetReference{Family: nftables.TableFamilyIPv4, TableName: "fw", SetName: "direct"}
+	if !cache.SetSnapshotContains(reference, net.ParseIP("10.1.2.3")) || cache.SetSnapshotContains(reference, net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Expected the first load to be done by the query")
+	}
+
+	// A stale snapshot answers with the old elements, and it's refreshed in background
+	_, network, _ = net.ParseCIDR("192.0.2.0/24")
+	conn.SetAddElements(direct, newIntervalElements(network))
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	SetSetSnapshotInterval(0)
+	contains := cache.SetSnapshotContains(reference, net.ParseIP("192.0.2.1"))
+	for i := 0; i < 100 && !contains; i++ {
+		time.Sleep(10 * time.Millisecond)
+		contains = cache.SetSnapshotContains(reference, net.ParseIP("192.0.2.1"))
+	}
+	if !contains || !cache.SetSnapshotContains(reference, net.ParseIP("10.1.2.3")) {
+		t.Fatalf("Expected the snapshot refreshed in background")
+	}
+
+	// Wait for the last refresh before the backend is restored
+	SetSetSnapshotInterval(time.Minute)
+	setSnapshotLock.Lock()
+	snapshot := setSnapshots[reference]
+	setSnapshotLock.Unlock()
+	for i := 0; i < 100; i++ {
+		snapshot.lock.RLock()
+		refreshing := snapshot.refreshing
+		snapshot.lock.RUnlock()
+		if !refreshing {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,242 @@
+package coredns_nftables
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Limits of RFC 7208 section 4.6.4
+const (
+	spfMaxLookups     = 10
+	spfMaxVoidLookups = 2
+)
+
+// spfResolver collects the networks authorized by SPF records.
+// Only ip4 and ip6 mechanisms are collected, include and redirect are followed,
+// and every mechanism which needs a DNS query counts to the lookup limit.
+type spfResolver struct {
+	lookup      func(name string) ([]string, error)
+	lookups     int
+	voidLookups int
+}
+
+func isSpfRecord(txt string) bool {
+	if len(txt) < 6 || !strings.EqualFold(txt[:6], "v=spf1") {
+		return false
+	}
+	return len(txt) == 6 || txt[6] == ' '
+}
+
+func (r *spfResolver) countLookup(name string) error {
+	r.lookups += 1
+	if r.lookups > spfMaxLookups {
+		return fmt.Errorf("spf lookup limit %v exceeded at %v", spfMaxLookups, name)
+	}
+	return nil
+}
+
+func (r *spfResolver) resolveDomain(domain string) ([]*net.IPNet, error) {
+	if err := r.countLookup(domain); err != nil {
+		return nil, err
+	}
+
+	txts, err := r.lookup(domain)
+	if err != nil {
+		return nil, err
+	}
+	// A void lookup counts to the void lookup limit, and the include or redirect of it is still a permanent error
+	if len(txts) == 0 {
+		r.voidLookups += 1
+		if r.voidLookups > spfMaxVoidLookups {
+			return nil, fmt.Errorf("spf void lookup limit %v exceeded at %v", spfMaxVoidLookups, domain)
+		}
+		return nil, fmt.Errorf("spf record of %v not found", domain)
+	}
+
+	var record string
+	for _, txt := range txts {
+		if !isSpfRecord(txt) {
+			continue
+		}
+		if record != "" {
+			return nil, fmt.Errorf("spf record of %v is duplicated", domain)
+		}
+		record = txt
+	}
+	if record == "" {
+		return nil, fmt.Errorf("spf record of %v not found", domain)
+	}
+
+	return r.resolveRecord(record)
+}
+
+func (r *spfResolver) resolveRecord(record string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	var redirect string
+	hasAll := false
+
+	for _, term := range strings.Fields(record)[1:] {
+		// modifiers
+		if equal := strings.IndexByte(term, '='); equal > 0 && !strings.ContainsAny(term[:equal], ":/") {
+			if strings.EqualFold(term[:equal], "redirect") {
+				redirect = term[equal+1:]
+			}
+			continue
+		}
+
+		qualifier := byte('+')
+		if strings.IndexByte("+-~?", term[0]) >= 0 {
+			qualifier = term[0]
+			term = term[1:]
+		}
+
+		name, value := term, ""
+		if separator := strings.IndexAny(term, ":/"); separator >= 0 {
+			name, value = term[:separator], strings.TrimPrefix(term[separator:], ":")
+		}
+
+		switch strings.ToLower(name) {
+		case "all":
+			hasAll = true
+		case "ip4", "ip6":
+			if qualifier != '+' {
+				continue
+			}
+			network, err := parseSpfNetwork(strings.ToLower(name), value)
+			if err != nil {
+				return nil, err
+			}
+			networks = append(networks, network)
+		case "include":
+			if strings.ContainsRune(value, '%') {
+				return nil, fmt.Errorf("spf macro in %v is not supported", term)
+			}
+			included, err := r.resolveDomain(value)
+			if err != nil {
+				return nil, err
+			}
+			if qualifier == '+' {
+				networks = append(networks, included...)
+			}
+		case "a", "mx", "ptr", "exists":
+			if err := r.countLookup(term); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if redirect != "" && !hasAll {
+		if strings.ContainsRune(redirect, '%') {
+			return nil, fmt.Errorf("spf macro in redirect=%v is not supported", redirect)
+		}
+		redirected, err := r.resolveDomain(redirect)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, redirected...)
+	}
+
+	return networks, nil
+}
+
+func parseSpfNetwork(mechanism string, value string) (*net.IPNet, error) {
+	if !strings.ContainsRune(value, '/') {
+		if mechanism == "ip4" {
+			value += "/32"
+		} else {
+			value += "/128"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("spf mechanism %v:%v invalid, %v", mechanism, value, err)
+	}
+	if (network.IP.To4() != nil) != (mechanism == "ip4") {
+		return nil, fmt.Errorf("spf mechanism %v:%v address family mismatch", mechanism, value)
+	}
+	return network, nil
+}
+
+// lookupTxt returns the TXT strings of name, a record with several strings is concatenated.
+func (m *NftablesHandler) lookupTxt(ctx context.Context, name string) ([]string, error) {
+	msg, err := m.lookup(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("lookup TXT of %v failed, %v", name, dns.RcodeToString[msg.Rcode])
+	}
+
+	var ret []string
+	for _, answer := range msg.Answer {
+		if txt, ok := answer.(*dns.TXT); ok {
+			ret = append(ret, strings.Join(txt.Txt, ""))
+		}
+	}
+	return ret, nil
+}
+
+func (m *NftablesHandler) hasSpfRule() bool {
+	for _, ruleSet := range m.Rules {
+		if len(ruleSet.RuleAddSpf) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// serveSpf adds the networks authorized by a SPF TXT answer into the sets of SPF rules.
+func (m *NftablesHandler) serveSpf(ctx context.Context, cache *NftablesCache, txt *dns.TXT, query *NftablesQuery) int {
+	record := strings.Join(txt.Txt, "")
+	if !isSpfRecord(record) {
+		return 0
+	}
+
+	resolver := &spfResolver{lookup: func(name string) ([]string, error) {
+		return m.lookupTxt(ctx, name)
+	}}
+	networks, err := resolver.resolveRecord(record)
+	if err != nil {
+		log.Warningf("Ignore spf record of %v, %v", txt.Hdr.Name, err)
+		return 0
+	}
+
+	applyCounter := 0
+	for _, network := range networks {
+		if m.isExcludedAddress(network.IP) {
+			log.Debugf("Ignore spf network %v(%v) because it's excluded", network.String(), txt.Hdr.Name)
+			continue
+		}
+
+		tableFamilies := ipv4TableFamilies
+		if network.IP.To4() == nil {
+			tableFamilies = ipv6TableFamilies
+		}
+
+		for _, family := range tableFamilies {
+			ruleSet, ok := m.Rules[family]
+			if !ok {
+				continue
+			}
+			for _, rule := range ruleSet.RuleAddSpf {
+				if !rule.Match(ctx, query) {
+					continue
+				}
+
+				err, ignored := rule.ServeCIDR(ctx, cache, network, family)
+				if err != nil {
+					log.Errorf("Add spf network %v(%v) to %v %v %v failed.%v", network.String(), txt.Hdr.Name, cache.GetFamilyName(family), rule.TableName, rule.SetName, err)
+				} else if !ignored {
+					applyCounter += 1
+				}
+			}
+		}
+	}
+
+	return applyCounter
+}
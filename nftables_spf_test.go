@@ -0,0 +1,69 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSpfResolver(t *testing.T) {
+	records := map[string][]string{
+		"_spf.example.org":      {"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 ~all"},
+		"_redirect.example.org": {"v=spf1 ip4:198.51.100.1 -all"},
+	}
+	for i := 0; i < 11; i++ {
+		records[fmt.Sprintf("loop%d.example.org", i)] = []string{fmt.Sprintf("v=spf1 include:loop%d.example.org", i+1)}
+	}
+	resolver := func() *spfResolver {
+		return &spfResolver{lookup: func(name string) ([]string, error) {
+			return records[name], nil
+		}}
+	}
+
+	networks, err := resolver().resolveRecord("v=spf1 ip4:203.0.113.7 include:_spf.example.org -ip4:10.0.0.0/8 redirect=_redirect.example.org")
+	if err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	expected := []string{"203.0.113.7/32", "192.0.2.0/24", "2001:db8::/32", "198.51.100.1/32"}
+	if len(networks) != len(expected) {
+		t.Fatalf("Expected networks %v, but got: %v", expected, networks)
+	}
+	for i, network := range networks {
+		if network.String() != expected[i] {
+			t.Fatalf("Expected networks %v, but got: %v", expected, networks)
+		}
+	}
+
+	if _, err := resolver().resolveRecord("v=spf1 include:loop0.example.org"); err == nil {
+		t.Fatalf("Expected lookup limit errors, but got: %v", err)
+	}
+	// include and redirect of a domain without SPF records fail the record
+	for _, record := range []string{"v=spf1 include:a.invalid ip4:192.0.2.1", "v=spf1 ip4:192.0.2.1 redirect=a.invalid"} {
+		if _, err := resolver().resolveRecord(record); err == nil || !strings.Contains(err.Error(), "not found") {
+			t.Fatalf("Expected missing record errors of %v, but got: %v", record, err)
+		}
+	}
+	voidResolver := resolver()
+	voidResolver.voidLookups = spfMaxVoidLookups
+	if _, err := voidResolver.resolveRecord("v=spf1 include:a.invalid"); err == nil || !strings.Contains(err.Error(), "void lookup limit") {
+		t.Fatalf("Expected void lookup limit errors, but got: %v", err)
+	}
+	if isSpfRecord("v=spf10 ip4:192.0.2.1") || !isSpfRecord("V=SPF1 -all") {
+		t.Fatalf("Unexpected SPF record detection")
+	}
+}
+
+func TestNewIntervalElements(t *testing.T) {
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	elements := newIntervalElements(network)
+	if len(elements) != 2 || !net.IP(elements[0].Key).Equal(net.ParseIP("192.0.2.0")) ||
+		!net.IP(elements[1].Key).Equal(net.ParseIP("192.0.3.0")) || !elements[1].IntervalEnd {
+		t.Fatalf("Unexpected interval elements %v", elements)
+	}
+
+	_, network, _ = net.ParseCIDR("ffff::/16")
+	if elements := newIntervalElements(network); len(elements) != 1 {
+		t.Fatalf("Unexpected interval elements %v", elements)
+	}
+}
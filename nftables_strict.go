@@ -0,0 +1,173 @@
+package coredns_nftables
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"syscall"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// strictMode disables implicit creation of tables, sets and ipsets, which are validated at startup
+var strictMode bool = false
+
+func SetNftablesStrictMode(mode bool) {
+	strictMode = mode
+}
+
+// errStrictNotFound returns the error of a missing table, set or ipset in strict mode
+func errStrictNotFound(kind string, name string) error {
+	return fmt.Errorf("%v %v not found and strict mode disables implicit creation: %w", kind, name, syscall.ENOENT)
+}
+
+// nftablesSetTarget is a set referenced by rules, in the network namespace Netns
+type nftablesSetTarget struct {
+	NftablesSetReference
+	IPSet bool
+}
+
+func (target *nftablesSetTarget) String() string {
+	if target.IPSet {
+		return "ipset " + target.SetName
+	}
+	return fmt.Sprintf("set %v %v %v", nftCliFamily(target.Family), target.TableName, target.SetName)
+}
+
+// nftablesTargetRule is a rule referencing a set, UnlessIn means it's referenced by unless-in
+type nftablesTargetRule struct {
+	Rule     *NftablesSetAddElement
+	Text     string
+	UnlessIn bool
+}
+
+// setTargets returns the sets referenced by set rules and unless-in of all families, with the rules referencing them
+func (m *NftablesHandler) setTargets() ([]nftablesSetTarget, map[nftablesSetTarget][]nftablesTargetRule, map[string]*NftablesNetns) {
+	var targets []nftablesSetTarget
+	rules := make(map[nftablesSetTarget][]nftablesTargetRule)
+	namespaces := make(map[string]*NftablesNetns)
+	add := func(target nftablesSetTarget, rule nftablesTargetRule) {
+		if _, ok := rules[target]; !ok {
+			targets = append(targets, target)
+		}
+		if !slices.Contains(rules[target], rule) {
+			rules[target] = append(rules[target], rule)
+		}
+		namespaces[target.Netns] = rule.Rule.Netns
+	}
+
+	for family, ruleSet := range m.Rules {
+		for i, ruleList := range [][]*NftablesSetAddElement{ruleSet.RuleAddElement, ruleSet.RuleAddSpf, ruleSet.RuleAddClient} {
+			for _, rule := range ruleList {
+				if rule.Route != nil {
+					continue
+				}
+				if rule.IPSet {
+					add(nftablesSetTarget{NftablesSetReference: NftablesSetReference{SetName: rule.SetName}, IPSet: true}, nftablesTargetRule{Rule: rule, Text: "ipset add " + rule.SetName})
+					continue
+				}
+				text := fmt.Sprintf("set add %v %v %v", []string{"element", "spf", "client"}[i], rule.TableName, rule.SetName)
+				add(nftablesSetTarget{NftablesSetReference: NftablesSetReference{Family: family, TableName: rule.TableName, SetName: rule.SetName, Netns: rule.Netns.String()}}, nftablesTargetRule{Rule: rule, Text: text})
+				for _, reference := range rule.UnlessIn {
+					reference.Family = family
+					reference.Netns = rule.Netns.String()
+					add(nftablesSetTarget{NftablesSetReference: reference}, nftablesTargetRule{Rule: rule, Text: text, UnlessIn: true})
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].String() < targets[j].String() })
+	return targets, rules, namespaces
+}
+
+// nftablesValidator looks up existing tables, sets and ipsets with one connection of every network namespace
+type nftablesValidator struct {
+	namespaces map[string]*NftablesNetns
+	conns      map[string]NftablesBackend
+	handles    []netns.NsHandle
+	ipsetConn  NftablesIPSetBackend
+}
+
+func (v *nftablesValidator) conn(key string) (NftablesBackend, error) {
+	if conn, ok := v.conns[key]; ok {
+		return conn, nil
+	}
+
+	var conn NftablesBackend
+	var ns netns.NsHandle
+	var err error
+	if key == "" {
+		conn, ns, err = nftablesBackendFactory()
+	} else {
+		conn, ns, err = nftablesNetnsBackendFactory(v.namespaces[key])
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.handles = append(v.handles, ns)
+	v.conns[key] = conn
+	return conn, nil
+}
+
+func (v *nftablesValidator) close() {
+	for _, conn := range v.conns {
+		if closer, ok := conn.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	for _, ns := range v.handles {
+		cleanupSystemNFTConn(ns)
+	}
+	if handle, ok := v.ipsetConn.(*netlink.Handle); ok {
+		handle.Close()
+	}
+}
+
+// getSet returns the existing set or ipset of target, or nil with the reason why it's not found
+func (v *nftablesValidator) getSet(target nftablesSetTarget) (*nftables.Set, *netlink.IPSetResult, error) {
+	if target.IPSet {
+		if v.ipsetConn == nil {
+			conn, err := ipsetBackendFactory()
+			if err != nil {
+				return nil, nil, err
+			}
+			v.ipsetConn = conn
+		}
+		header, err := v.ipsetConn.IpsetList(target.SetName)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, header, nil
+	}
+
+	conn, err := v.conn(target.Netns)
+	if err != nil {
+		return nil, nil, err
+	}
+	tables, err := conn.ListTablesOfFamily(target.Family)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, table := range tables {
+		if table.Name == target.TableName {
+			set, err := conn.GetSetByName(table, target.SetName)
+			if err != nil {
+				return nil, nil, err
+			}
+			return set, nil, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("table %v %v not found: %w", nftCliFamily(target.Family), target.TableName, syscall.ENOENT)
+}
+
+// ValidateStrict checks all sets referenced by rules exist in strict mode, and returns all missing ones in one error
+func (m *NftablesHandler) ValidateStrict() error {
+	if !strictMode {
+		return nil
+	}
+	return m.Validate().strictError()
+}
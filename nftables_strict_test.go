@@ -0,0 +1,52 @@
+package coredns_nftables
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+)
+
+func TestStrictMode(t *testing.T) {
+	ruleset := withMemoryBackend(t)
+	conn := ruleset.Open()
+	table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"})
+	conn.AddSet(&nftables.Set{Table: table, Name: "proxy", KeyType: nftables.TypeIPAddr}, nil)
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	defer SetNftablesStrictMode(false)
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		strict
+		set add element fw proxy ip false unless-in fw direct
+		set add element fw2 proxy ip false
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	err := handle.ValidateStrict()
+	if err == nil || !strings.Contains(err.Error(), "set ip fw direct") || !strings.Contains(err.Error(), "set ip fw2 proxy") ||
+		strings.Contains(err.Error(), "set ip fw proxy") {
+		t.Fatalf("Expected errors of fw direct and fw2 proxy, but got: %v", err)
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("192.0.2.1")})
+	if _, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1"))); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if !ruleset.Contains(nftables.TableFamilyIPv4, "fw", "proxy", net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Expected element added into the existing set")
+	}
+	if tables, _ := ruleset.Open().ListTablesOfFamily(nftables.TableFamilyIPv4); len(tables) != 1 {
+		t.Fatalf("Expected no table created in strict mode, but got: %v", tables)
+	}
+}
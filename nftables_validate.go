@@ -0,0 +1,221 @@
+package coredns_nftables
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ValidateSeverityInfo    = "info"
+	ValidateSeverityWarning = "warning"
+	ValidateSeverityError   = "error"
+)
+
+const (
+	ValidatePolicyOff  = "off"
+	ValidatePolicyWarn = "warn"
+	ValidatePolicyFail = "fail"
+)
+
+// validatePolicy decides whether errors of the validation report fail the startup
+var validatePolicy string = ValidatePolicyWarn
+
+func SetNftablesValidatePolicy(policy string) {
+	validatePolicy = policy
+}
+
+// NftablesValidationIssue is a problem of an existing set, which prevents or degrades a rule
+type NftablesValidationIssue struct {
+	// Target is the set or ipset, such as "set ip fw proxy"
+	Target string
+	Netns  string
+	// Rule is the rule referencing Target, such as "set add element fw proxy"
+	Rule     string
+	Severity string
+	// Missing means Target doesn't exist, which is only an error in strict mode
+	Missing bool
+	Message string
+}
+
+func (issue *NftablesValidationIssue) String() string {
+	target := issue.Target
+	if issue.Netns != "" {
+		target = fmt.Sprintf("%v in netns %v", issue.Target, issue.Netns)
+	}
+	if issue.Rule == "" {
+		return fmt.Sprintf("[%v] %v: %v", issue.Severity, target, issue.Message)
+	}
+	return fmt.Sprintf("[%v] %v of %v: %v", issue.Severity, target, issue.Rule, issue.Message)
+}
+
+// NftablesValidationReport is the result of validating existing sets against rules at startup
+type NftablesValidationReport struct {
+	// Validated is the count of sets and ipsets which are looked up
+	Validated int
+	Issues    []NftablesValidationIssue
+}
+
+func (report *NftablesValidationReport) add(target nftablesSetTarget, rule *nftablesTargetRule, severity string, format string, args ...interface{}) *NftablesValidationIssue {
+	issue := NftablesValidationIssue{Target: target.String(), Netns: target.Netns, Severity: severity, Message: fmt.Sprintf(format, args...)}
+	if rule != nil {
+		issue.Rule = rule.Text
+	}
+	report.Issues = append(report.Issues, issue)
+	return &report.Issues[len(report.Issues)-1]
+}
+
+// Count returns the count of issues of severity
+func (report *NftablesValidationReport) Count(severity string) int {
+	ret := 0
+	for _, issue := range report.Issues {
+		if issue.Severity == severity {
+			ret += 1
+		}
+	}
+	return ret
+}
+
+func (report *NftablesValidationReport) String() string {
+	lines := []string{fmt.Sprintf("%v set(s) validated, %v error(s), %v warning(s)", report.Validated,
+		report.Count(ValidateSeverityError), report.Count(ValidateSeverityWarning))}
+	for _, issue := range report.Issues {
+		lines = append(lines, issue.String())
+	}
+	return strings.Join(lines, "\n\t")
+}
+
+func (report *NftablesValidationReport) strictError() error {
+	var missing []string
+	for _, issue := range report.Issues {
+		if issue.Missing {
+			missing = append(missing, issue.String())
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("strict mode requires existing tables and sets, %v of them are missing:\n\t%v", len(missing), strings.Join(missing, "\n\t"))
+	}
+	return nil
+}
+
+// Validate looks up the sets and ipsets referenced by rules, and reports the ones missing or incompatible with rules
+func (m *NftablesHandler) Validate() *NftablesValidationReport {
+	targets, rules, namespaces := m.setTargets()
+	validator := &nftablesValidator{namespaces: namespaces, conns: make(map[string]NftablesBackend)}
+	defer validator.close()
+
+	report := &NftablesValidationReport{}
+	for _, target := range targets {
+		report.Validated += 1
+		set, header, err := validator.getSet(target)
+		if err != nil {
+			if !errors.Is(err, syscall.ENOENT) {
+				report.add(target, nil, ValidateSeverityError, "lookup failed, %v", err)
+				continue
+			}
+			severity := ValidateSeverityInfo
+			message := "not found, it's created by the first answer"
+			if strictMode {
+				severity = ValidateSeverityError
+				message = fmt.Sprintf("not found, %v", err)
+			}
+			report.add(target, nil, severity, "%v", message).Missing = true
+			continue
+		}
+
+		for _, rule := range rules[target] {
+			if target.IPSet {
+				validateIPSet(report, target, &rule, header)
+			} else {
+				validateSet(report, target, &rule, set)
+			}
+		}
+	}
+	return report
+}
+
+func validateSet(report *NftablesValidationReport, target nftablesSetTarget, rule *nftablesTargetRule, set *nftables.Set) {
+	keyType := set.KeyType.Name
+	if keyType != nftables.TypeIPAddr.Name && keyType != nftables.TypeIP6Addr.Name {
+		severity := ValidateSeverityError
+		if rule.UnlessIn {
+			severity = ValidateSeverityWarning
+		}
+		report.add(target, rule, severity, "key type %v doesn't accept addresses", keyType)
+		return
+	}
+	if rule.UnlessIn {
+		return
+	}
+
+	if set.Constant {
+		report.add(target, rule, ValidateSeverityError, "set is constant, elements can't be added")
+	}
+	if rule.Rule.KeyType != nftables.TypeInvalid && rule.Rule.KeyType.Name != keyType {
+		report.add(target, rule, ValidateSeverityError, "rule adds %v but key type of set is %v", rule.Rule.KeyType.Name, keyType)
+	}
+	if rule.Rule.Interval && !set.Interval {
+		report.add(target, rule, ValidateSeverityError, "rule adds networks but set has no interval flag")
+	}
+	if rule.Rule.Timeout > 0 && !set.HasTimeout {
+		report.add(target, rule, ValidateSeverityWarning, "timeout %v of rule is ignored because set has no timeout flag", rule.Rule.Timeout)
+	}
+}
+
+func validateIPSet(report *NftablesValidationReport, target nftablesSetTarget, rule *nftablesTargetRule, header *netlink.IPSetResult) {
+	if header.TypeName != "hash:ip" && header.TypeName != "hash:net" {
+		report.add(target, rule, ValidateSeverityError, "type %v is not supported, only hash:ip and hash:net are supported", header.TypeName)
+		return
+	}
+
+	if (rule.Rule.KeyType == nftables.TypeIPAddr && header.Family != unix.AF_INET) ||
+		(rule.Rule.KeyType == nftables.TypeIP6Addr && header.Family != unix.AF_INET6) {
+		report.add(target, rule, ValidateSeverityError, "rule adds %v but family of ipset is %v", rule.Rule.KeyType.Name, header.Family)
+	}
+	if rule.Rule.Interval && header.TypeName != "hash:net" {
+		report.add(target, rule, ValidateSeverityWarning, "rule adds networks but ipset is %v, only addresses are added", header.TypeName)
+	}
+	if rule.Rule.Timeout > 0 && header.Timeout == nil {
+		report.add(target, rule, ValidateSeverityWarning, "timeout %v of rule is ignored because ipset has no timeout", rule.Rule.Timeout)
+	}
+	if rule.Rule.Comment != "" && header.CadtFlags&nl.IPSET_FLAG_WITH_COMMENT == 0 {
+		report.add(target, rule, ValidateSeverityWarning, "comment of rule is ignored because ipset has no comment support")
+	}
+}
+
+// ValidateAtStartup logs the validation report, and fails by missing sets in strict mode, or by errors with the fail policy
+func (m *NftablesHandler) ValidateAtStartup() error {
+	if validatePolicy == ValidatePolicyOff && !strictMode {
+		return nil
+	}
+
+	report := m.Validate()
+	for _, issue := range report.Issues {
+		switch issue.Severity {
+		case ValidateSeverityError:
+			log.Errorf("Nftables validate %v", issue.String())
+		case ValidateSeverityWarning:
+			log.Warningf("Nftables validate %v", issue.String())
+		default:
+			log.Infof("Nftables validate %v", issue.String())
+		}
+	}
+	log.Infof("Nftables validate %v set(s) done, %v error(s), %v warning(s)", report.Validated,
+		report.Count(ValidateSeverityError), report.Count(ValidateSeverityWarning))
+
+	if strictMode {
+		if err := report.strictError(); err != nil {
+			return err
+		}
+	}
+	if validatePolicy == ValidatePolicyFail && report.Count(ValidateSeverityError) > 0 {
+		return fmt.Errorf("validate sets failed, %v", report.String())
+	}
+	return nil
+}
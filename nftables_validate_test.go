@@ -0,0 +1,63 @@
+package coredns_nftables
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/google/nftables"
+)
+
+func TestValidateSets(t *testing.T) {
+	ruleset := withMemoryBackend(t)
+	conn := ruleset.Open()
+	table := conn.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: "fw"})
+	conn.AddSet(&nftables.Set{Table: table, Name: "proxy", KeyType: nftables.TypeIPAddr}, nil)
+	conn.AddSet(&nftables.Set{Table: table, Name: "mac", KeyType: nftables.TypeEtherAddr}, nil)
+	conn.AddSet(&nftables.Set{Table: table, Name: "static", KeyType: nftables.TypeIPAddr, Constant: true}, nil)
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	defer SetNftablesValidatePolicy(ValidatePolicyWarn)
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		validate fail
+		set add element fw proxy ip true 1h
+		set add element fw mac ip false
+		set add element fw static ip false unless-in fw mac
+		set add element fw missing ip false
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	report := handle.Validate()
+	if report.Validated != 4 {
+		t.Fatalf("Expected 4 sets validated, but got: %v", report.String())
+	}
+	expected := []string{
+		"[error] set ip fw mac of set add element fw mac: key type ether_addr",
+		"[warning] set ip fw mac of set add element fw static: key type ether_addr",
+		"[info] set ip fw missing: not found",
+		"[error] set ip fw proxy of set add element fw proxy: rule adds networks",
+		"[warning] set ip fw proxy of set add element fw proxy: timeout 1h0m0s",
+		"[error] set ip fw static of set add element fw static: set is constant",
+	}
+	if len(report.Issues) != len(expected) {
+		t.Fatalf("Expected %v issues, but got: %v", len(expected), report.String())
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(report.Issues[i].String(), prefix) {
+			t.Fatalf("Expected issue %v starts with %q, but got: %v", i, prefix, report.Issues[i].String())
+		}
+	}
+
+	if err := handle.ValidateAtStartup(); err == nil || !strings.Contains(err.Error(), "3 error(s), 2 warning(s)") {
+		t.Fatalf("Expected validation failed, but got: %v", err)
+	}
+	SetNftablesValidatePolicy(ValidatePolicyWarn)
+	if err := handle.ValidateAtStartup(); err != nil {
+		t.Fatalf("Expected only warnings, but got: %v", err)
+	}
+}
@@ -1,6 +1,9 @@
 package coredns_nftables
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net"
 	"strconv"
 	"strings"
 	"time"
@@ -9,6 +12,7 @@ import (
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	"github.com/google/nftables"
+	"github.com/miekg/dns"
 )
 
 func init() {
@@ -22,6 +26,43 @@ func setup(c *caddy.Controller) error {
 		return plugin.Error("nftables", err)
 	}
 
+	if !handle.Definitions.Empty() {
+		c.OnStartup(func() error {
+			if err := handle.Provision(); err != nil {
+				return plugin.Error("nftables", err)
+			}
+			return nil
+		})
+	}
+	// Validate after definitions are provisioned
+	c.OnStartup(func() error {
+		if err := handle.ValidateAtStartup(); err != nil {
+			return plugin.Error("nftables", err)
+		}
+		return nil
+	})
+
+	if monitorEnabled {
+		c.OnStartup(func() error {
+			StartNftablesMonitor()
+			return nil
+		})
+		c.OnShutdown(func() error {
+			StopNftablesMonitor()
+			return nil
+		})
+	}
+	if handle.hasRouteExpiry() {
+		c.OnStartup(func() error {
+			StartRouteExpiry()
+			return nil
+		})
+		c.OnShutdown(func() error {
+			StopRouteExpiry()
+			return nil
+		})
+	}
+
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		handle.Next = next
 		ClearCache()
@@ -68,6 +109,13 @@ func parse(c *caddy.Controller, handle *NftablesHandler) error {
 			families = append(families, nftables.TableFamilyINet)
 		}
 
+		blockRules := make(map[*NftablesSetAddElement]bool)
+		for _, rule := range handle.allRules() {
+			blockRules[rule] = false
+		}
+		var blockNetns *NftablesNetns
+		blockDefinitions := handle.Definitions
+
 		// Refinements? In an extra block.
 		for c.NextBlock() {
 			switch strings.ToLower(c.Val()) {
@@ -83,6 +131,10 @@ func parse(c *caddy.Controller, handle *NftablesHandler) error {
 						err = setupSetAddElement(c, handle, allowAutoIpAddr, families, args)
 					} else if strings.ToLower(args[0]) == "lru" {
 						err = setupSetLruOptions(c, handle, args)
+					} else if strings.ToLower(args[0]) == "snapshot" {
+						err = setupSetSnapshotOptions(c, args)
+					} else if strings.ToLower(args[0]) == "handle" {
+						err = setupSetHandleOptions(c, args)
 					} else {
 						return c.Errf("nftables set action %v invalid", args[0])
 					}
@@ -91,6 +143,46 @@ func parse(c *caddy.Controller, handle *NftablesHandler) error {
 					}
 				}
 
+			case "ipset":
+				{
+					if err := setupIPSetAddElement(c, handle, c.RemainingArgs()); err != nil {
+						return err
+					}
+				}
+
+			case "route":
+				{
+					if err := setupRouteAddElement(c, handle, c.RemainingArgs()); err != nil {
+						return err
+					}
+				}
+
+			case "define":
+				{
+					if err := setupDefinition(c, handle, c.RemainingArgs()); err != nil {
+						return err
+					}
+				}
+
+			case "netns":
+				{
+					if blockNetns != nil {
+						return c.Errf("nftables netns of block is already set to %v", blockNetns.String())
+					}
+					parseNetnsValue, err := parseNetns(c.RemainingArgs())
+					if err != nil {
+						return c.Errf("nftables %v", err)
+					}
+					blockNetns = parseNetnsValue
+				}
+
+			case "backend":
+				{
+					if err := setupBackendOptions(c, c.RemainingArgs()); err != nil {
+						return err
+					}
+				}
+
 			case "connection":
 				{
 					args := c.RemainingArgs()
@@ -109,6 +201,134 @@ func parse(c *caddy.Controller, handle *NftablesHandler) error {
 					SetConnectionTimeout(parseTimeout)
 				}
 
+			case "ecs":
+				{
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables ecs argument count invalid")
+					}
+
+					for _, arg := range args {
+						network, err := parseNetwork(arg)
+						if err != nil {
+							return c.Errf("nftables ecs trusted forwarder %v invalid, %v", arg, err)
+						}
+						handle.EcsTrustedForwarders = append(handle.EcsTrustedForwarders, network)
+					}
+				}
+
+			case "exclude-cidr":
+				{
+					args := c.RemainingArgs()
+					if len(args) < 1 {
+						return c.Errf("nftables exclude-cidr argument count invalid")
+					}
+
+					networks, err := parseExcludeNetworks(args)
+					if err != nil {
+						return c.Errf("nftables %v", err)
+					}
+					handle.Excludes = append(handle.Excludes, networks...)
+				}
+
+			case "geoip", "asn":
+				{
+					databaseType := strings.ToLower(c.Val())
+					args := c.RemainingArgs()
+					if len(args) < 2 || strings.ToLower(args[0]) != "database" {
+						return c.Errf("nftables %v argument invalid, only %v database <PATH> is supported", databaseType, databaseType)
+					}
+
+					database, err := openMmdbDatabase(args[1])
+					if err != nil {
+						return c.Errf("nftables %v database %v invalid, %v", databaseType, args[1], err)
+					}
+					if databaseType == "geoip" {
+						handle.GeoIP.Country = database
+					} else {
+						handle.GeoIP.ASN = database
+					}
+				}
+
+			case "strict":
+				{
+					args := c.RemainingArgs()
+					parseStrict := true
+					if len(args) > 1 {
+						return c.Errf("nftables strict argument count invalid")
+					} else if len(args) == 1 {
+						var err error
+						if parseStrict, err = strconv.ParseBool(args[0]); err != nil {
+							return c.Errf("nftables strict argument %v invalid, %v", args[0], err)
+						}
+					}
+
+					SetNftablesStrictMode(parseStrict)
+				}
+
+			case "validate":
+				{
+					args := c.RemainingArgs()
+					if len(args) != 1 {
+						return c.Errf("nftables validate argument count invalid")
+					}
+					policy := strings.ToLower(args[0])
+					if policy != ValidatePolicyOff && policy != ValidatePolicyWarn && policy != ValidatePolicyFail {
+						return c.Errf("nftables validate policy %v invalid, only off, warn and fail are supported", args[0])
+					}
+
+					SetNftablesValidatePolicy(policy)
+				}
+
+			case "monitor":
+				{
+					args := c.RemainingArgs()
+					parseMonitor := true
+					parseReinsert := false
+					if len(args) > 0 && strings.ToLower(args[len(args)-1]) == "reinsert" {
+						parseReinsert = true
+						args = args[:len(args)-1]
+					}
+					if len(args) > 1 {
+						return c.Errf("nftables monitor argument count invalid")
+					} else if len(args) == 1 {
+						var err error
+						if parseMonitor, err = strconv.ParseBool(args[0]); err != nil {
+							return c.Errf("nftables monitor argument %v invalid, %v", args[0], err)
+						}
+					}
+
+					SetNftablesMonitor(parseMonitor, parseReinsert)
+				}
+
+			case "coalesce":
+				{
+					args := c.RemainingArgs()
+					if len(args) != 1 && (len(args) != 3 || strings.ToLower(args[1]) != "max") {
+						return c.Errf("nftables coalesce argument invalid, only coalesce <window> [max <elements>] is supported")
+					}
+
+					var parseWindow time.Duration
+					if strings.ToLower(args[0]) != "off" {
+						var err error
+						if parseWindow, err = time.ParseDuration(args[0]); err != nil {
+							return c.Errf("nftables coalesce window argument %v invalid, %v", args[0], err)
+						}
+					}
+					parseMaxElements := coalesceMaxElements
+					if len(args) == 3 {
+						parseMax, err := strconv.ParseInt(args[2], 10, 32)
+						if err != nil {
+							return c.Errf("nftables coalesce max argument %v invalid, %v", args[2], err)
+						} else if parseMax <= 0 {
+							return c.Errf("nftables coalesce max argument %v invalid, it must be greater than 0", args[2])
+						}
+						parseMaxElements = int(parseMax)
+					}
+
+					SetNftablesCoalesce(parseWindow, parseMaxElements)
+				}
+
 			case "async":
 				{
 					args := c.RemainingArgs()
@@ -129,9 +349,59 @@ func parse(c *caddy.Controller, handle *NftablesHandler) error {
 			}
 		}
 
+		if err := setupBlockNetns(c, handle, blockRules, &blockDefinitions, blockNetns); err != nil {
+			return err
+		}
+
 		log.Debug("Successfully parsed configuration")
 	}
 
+	return validateGeoIPRules(c, handle)
+}
+
+// setupBlockNetns sets the network namespace of the block to its rules and definitions,
+// which are not in blockRules and blockDefinitions before the block
+func setupBlockNetns(c *caddy.Controller, handle *NftablesHandler, blockRules map[*NftablesSetAddElement]bool, blockDefinitions *NftablesDefinitions, blockNetns *NftablesNetns) error {
+	if blockNetns == nil {
+		return nil
+	}
+
+	for _, set := range handle.Definitions.Sets[len(blockDefinitions.Sets):] {
+		if set.Netns == nil {
+			set.Netns = blockNetns
+		}
+	}
+	for _, chain := range handle.Definitions.Chains[len(blockDefinitions.Chains):] {
+		if chain.Netns == nil {
+			chain.Netns = blockNetns
+		}
+	}
+
+	for _, rule := range handle.allRules() {
+		if _, ok := blockRules[rule]; ok || rule.Netns != nil {
+			continue
+		}
+		if rule.IPSet || rule.Route != nil {
+			return c.Errf("nftables netns %v is only supported by set rules", blockNetns.String())
+		}
+		rule.Netns = blockNetns
+	}
+	return nil
+}
+
+func validateGeoIPRules(c *caddy.Controller, handle *NftablesHandler) error {
+	for _, ruleSet := range handle.Rules {
+		for _, rules := range [][]*NftablesSetAddElement{ruleSet.RuleAddElement, ruleSet.RuleAddSpf, ruleSet.RuleAddClient} {
+			for _, rule := range rules {
+				if rule.GeoIPFilter.HasCountry() && handle.GeoIP.Country == nil {
+					return c.Errf("nftables set %v %v uses geoip but geoip database is not set", rule.TableName, rule.SetName)
+				}
+				if rule.GeoIPFilter.HasASN() && handle.GeoIP.ASN == nil {
+					return c.Errf("nftables set %v %v uses asn but asn database is not set", rule.TableName, rule.SetName)
+				}
+			}
+		}
+	}
 	return nil
 }
 
@@ -147,9 +417,13 @@ func setupSetAddElement(c *caddy.Controller, handle *NftablesHandler, allowAutoI
 	setRuleIsInterval := false
 	var setRuleTimeout time.Duration // time.ParseDuration()
 	keyType := nftables.TypeInvalid
-	if setRuleAction != "add" || setRuleTarget != "element" {
+	if setRuleAction != "add" || (setRuleTarget != "element" && setRuleTarget != "spf" && setRuleTarget != "client") {
 		return c.Errf("nftables set action %v invalid", setRuleTarget)
 	}
+	// Networks of SPF records are always added as intervals
+	if setRuleTarget == "spf" {
+		setRuleIsInterval = true
+	}
 	nextArgIndex := 4
 
 	if len(args) > nextArgIndex {
@@ -170,7 +444,7 @@ func setupSetAddElement(c *caddy.Controller, handle *NftablesHandler, allowAutoI
 		return c.Errf("nftables set action %v address type invalid, only ip and ip6 family support auto address type", setRuleTarget)
 	}
 
-	if len(args) > nextArgIndex {
+	if len(args) > nextArgIndex && setRuleTarget != "spf" {
 		tryInterval := strings.ToLower(args[nextArgIndex])
 		if parseBool, err := strconv.ParseBool(tryInterval); err == nil {
 			setRuleIsInterval = parseBool
@@ -185,11 +459,72 @@ func setupSetAddElement(c *caddy.Controller, handle *NftablesHandler, allowAutoI
 		}
 	}
 
-	for i := nextArgIndex; i < len(args); i++ {
-		log.Warningf("Ignore invalid setting %s", args[i])
+	rule := NftablesSetAddElement{TableName: setRuleTableName, SetName: setRuleSetName, Interval: setRuleIsInterval, Timeout: setRuleTimeout, KeyType: keyType}
+	if err := setupRuleOptions(c, handle, &rule, args[nextArgIndex:]); err != nil {
+		return err
 	}
 
-	rule := NftablesSetAddElement{TableName: setRuleTableName, SetName: setRuleSetName, Interval: setRuleIsInterval, Timeout: setRuleTimeout, KeyType: keyType}
+	for _, family := range families {
+		ruleSet := handle.MutableRuleSet(family)
+		switch setRuleTarget {
+		case "spf":
+			ruleSet.RuleAddSpf = append(ruleSet.RuleAddSpf, &rule)
+		case "client":
+			ruleSet.RuleAddClient = append(ruleSet.RuleAddClient, &rule)
+		default:
+			ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &rule)
+		}
+	}
+
+	return nil
+}
+
+// setupIPSetAddElement parses ipset add <SETNAME> [ip/ip6] [hash:ip/hash:net] [timeout] [OPTIONS...],
+// ipset rules don't depend on the families of block and use ip by default like ipset.
+func setupIPSetAddElement(c *caddy.Controller, handle *NftablesHandler, args []string) error {
+	if len(args) < 2 || strings.ToLower(args[0]) != "add" {
+		return c.Errf("nftables ipset argument invalid, only ipset add <SETNAME> is supported")
+	}
+
+	rule := NftablesSetAddElement{SetName: args[1], KeyType: nftables.TypeIPAddr, IPSet: true}
+	families := []nftables.TableFamily{nftables.TableFamilyIPv4}
+	nextArgIndex := 2
+	if len(args) > nextArgIndex {
+		switch strings.ToLower(args[nextArgIndex]) {
+		case "ip":
+			nextArgIndex += 1
+		case "ip6":
+			rule.KeyType = nftables.TypeIP6Addr
+			families = []nftables.TableFamily{nftables.TableFamilyIPv6}
+			nextArgIndex += 1
+		case "auto":
+			return c.Errf("nftables ipset %v family auto is not supported, an ipset holds only one family", rule.SetName)
+		}
+	}
+
+	if len(args) > nextArgIndex {
+		switch strings.ToLower(args[nextArgIndex]) {
+		case "hash:ip":
+			nextArgIndex += 1
+		case "hash:net":
+			rule.Interval = true
+			nextArgIndex += 1
+		}
+	}
+
+	if len(args) > nextArgIndex {
+		if parseTimeout, err := time.ParseDuration(args[nextArgIndex]); err == nil {
+			rule.Timeout = parseTimeout
+			nextArgIndex += 1
+		}
+	}
+
+	if err := setupRuleOptions(c, handle, &rule, args[nextArgIndex:]); err != nil {
+		return err
+	}
+	if rule.Netns != nil {
+		return c.Errf("nftables netns %v is only supported by set rules", rule.Netns.String())
+	}
 
 	for _, family := range families {
 		ruleSet := handle.MutableRuleSet(family)
@@ -199,6 +534,166 @@ func setupSetAddElement(c *caddy.Controller, handle *NftablesHandler, allowAutoI
 	return nil
 }
 
+// setupRouteAddElement parses route add <TABLE_ID> via <GATEWAY>|dev <DEVICE> [timeout] [OPTIONS...],
+// route rules don't depend on the families of block.
+func setupRouteAddElement(c *caddy.Controller, handle *NftablesHandler, args []string) error {
+	if len(args) < 4 || strings.ToLower(args[0]) != "add" {
+		return c.Errf("nftables route argument invalid, only route add <TABLE_ID> via <GATEWAY>|dev <DEVICE> is supported")
+	}
+
+	table, err := strconv.Atoi(args[1])
+	if err != nil {
+		return c.Errf("nftables route table %v invalid, %v", args[1], err)
+	}
+	if table <= 0 {
+		return c.Errf("nftables route table %v invalid, it must be a positive table id", args[1])
+	}
+	route := &NftablesRoute{Table: table}
+	nextArgIndex := 2
+	for ; len(args) > nextArgIndex+1; nextArgIndex += 2 {
+		option := strings.ToLower(args[nextArgIndex])
+		if option == "via" {
+			route.Gateway = net.ParseIP(args[nextArgIndex+1])
+			if route.Gateway == nil {
+				return c.Errf("nftables route gateway %v invalid", args[nextArgIndex+1])
+			}
+		} else if option == "dev" {
+			route.Device = args[nextArgIndex+1]
+		} else {
+			break
+		}
+	}
+	if route.Gateway == nil && route.Device == "" {
+		return c.Errf("nftables route %v requires via <GATEWAY> or dev <DEVICE>", table)
+	}
+
+	rule := NftablesSetAddElement{Route: route, KeyType: nftables.TypeInvalid}
+	if len(args) > nextArgIndex {
+		if parseTimeout, err := time.ParseDuration(args[nextArgIndex]); err == nil {
+			rule.Timeout = parseTimeout
+			nextArgIndex += 1
+		}
+	}
+	if err := setupRuleOptions(c, handle, &rule, args[nextArgIndex:]); err != nil {
+		return err
+	}
+	if rule.Netns != nil {
+		return c.Errf("nftables netns %v is only supported by set rules", rule.Netns.String())
+	}
+
+	families := []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6}
+	if route.Gateway != nil && route.Gateway.To4() != nil {
+		families = []nftables.TableFamily{nftables.TableFamilyIPv4}
+	} else if route.Gateway != nil {
+		families = []nftables.TableFamily{nftables.TableFamilyIPv6}
+	}
+	for _, family := range families {
+		ruleSet := handle.MutableRuleSet(family)
+		ruleSet.RuleAddElement = append(ruleSet.RuleAddElement, &rule)
+	}
+
+	return nil
+}
+
+// setupDefinition parses define set|chain <family> <table> <name> { <STATEMENT>... },
+// statements are separated by lines or semicolons.
+func setupDefinition(c *caddy.Controller, handle *NftablesHandler, args []string) error {
+	if len(args) != 4 || (strings.ToLower(args[0]) != "set" && strings.ToLower(args[0]) != "chain") {
+		return c.Errf("nftables define argument invalid, only define set|chain <family> <table> <name> { ... } is supported")
+	}
+	family := parseNftCliFamily(strings.ToLower(args[1]))
+	if family == nftables.TableFamilyUnspecified {
+		return c.Errf("nftables define %v family %v invalid", args[0], args[1])
+	}
+
+	var statements [][]string
+	var statement []string
+	for c.NextBlock() {
+		for _, token := range append([]string{c.Val()}, c.RemainingArgs()...) {
+			end := strings.HasSuffix(token, ";")
+			if token = strings.TrimSuffix(token, ";"); token != "" {
+				statement = append(statement, token)
+			}
+			if end && len(statement) > 0 {
+				statements = append(statements, statement)
+				statement = nil
+			}
+		}
+		if len(statement) > 0 {
+			statements = append(statements, statement)
+			statement = nil
+		}
+	}
+
+	if strings.ToLower(args[0]) == "set" {
+		set, err := parseSetDefinition(family, args[2], args[3], statements)
+		if err != nil {
+			return c.Errf("nftables define set %v %v invalid, %v", args[2], args[3], err)
+		}
+		handle.Definitions.Sets = append(handle.Definitions.Sets, set)
+	} else {
+		chain, err := parseChainDefinition(family, args[2], args[3], statements)
+		if err != nil {
+			return c.Errf("nftables define chain %v %v invalid, %v", args[2], args[3], err)
+		}
+		handle.Definitions.Chains = append(handle.Definitions.Chains, chain)
+	}
+	return nil
+}
+
+// setupBackendOptions parses backend netlink, backend nft [BINARY] [flush <INTERVAL>] or backend remote <ADDRESS> [tls <CERT> <KEY> <CA>]
+func setupBackendOptions(c *caddy.Controller, args []string) error {
+	if len(args) < 1 {
+		return c.Errf("nftables backend argument count invalid")
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "netlink":
+		if len(args) > 1 {
+			return c.Errf("nftables backend netlink has no argument")
+		}
+		SetNftablesBackendFactory(nil)
+	case "nft":
+		binary := "nft"
+		var flushInterval time.Duration
+		nextArgIndex := 1
+		if len(args) > nextArgIndex && strings.ToLower(args[nextArgIndex]) != "flush" {
+			binary = args[nextArgIndex]
+			nextArgIndex += 1
+		}
+		if len(args) > nextArgIndex {
+			if len(args) != nextArgIndex+2 || strings.ToLower(args[nextArgIndex]) != "flush" {
+				return c.Errf("nftables backend nft argument %v invalid", args[nextArgIndex:])
+			}
+			parseInterval, err := time.ParseDuration(args[nextArgIndex+1])
+			if err != nil {
+				return c.Errf("nftables backend nft flush interval %v invalid, %v", args[nextArgIndex+1], err)
+			}
+			flushInterval = parseInterval
+		}
+		SetNftCliBackend(binary, flushInterval)
+	case "remote":
+		if len(args) != 2 && (len(args) != 6 || strings.ToLower(args[2]) != "tls") {
+			return c.Errf("nftables backend remote argument %v invalid", args[1:])
+		}
+		var tlsConfig *tls.Config
+		if len(args) == 6 {
+			parseTLSConfig, err := NewRemoteTLSConfig(args[3], args[4], args[5])
+			if err != nil {
+				return c.Errf("nftables backend remote tls invalid, %v", err)
+			}
+			tlsConfig = parseTLSConfig
+		}
+		if err := SetRemoteBackend(args[1], tlsConfig); err != nil {
+			return c.Errf("nftables backend remote %v", err)
+		}
+	default:
+		return c.Errf("nftables backend %v invalid, only netlink, nft and remote are supported", args[0])
+	}
+
+	return nil
+}
+
 func setupSetLruOptions(c *caddy.Controller, handle *NftablesHandler, args []string) error {
 	if len(args) <= 2 {
 		return c.Errf("nftables set lru argument count invalid")
@@ -237,3 +732,181 @@ func setupSetLruOptions(c *caddy.Controller, handle *NftablesHandler, args []str
 
 	return nil
 }
+
+func setupSetSnapshotOptions(c *caddy.Controller, args []string) error {
+	if len(args) <= 2 || strings.ToLower(args[1]) != "interval" {
+		return c.Errf("nftables set snapshot argument invalid, only set snapshot interval <interval> is supported")
+	}
+
+	parseInterval, err := time.ParseDuration(args[2])
+	if err != nil {
+		return c.Errf("nftables set snapshot interval argument %v invalid, %v", args[2], err)
+	}
+	SetSetSnapshotInterval(parseInterval)
+
+	return nil
+}
+
+func setupSetHandleOptions(c *caddy.Controller, args []string) error {
+	if len(args) <= 2 || strings.ToLower(args[1]) != "ttl" {
+		return c.Errf("nftables set handle argument invalid, only set handle ttl <ttl> is supported")
+	}
+
+	parseTTL, err := time.ParseDuration(args[2])
+	if err != nil {
+		return c.Errf("nftables set handle ttl argument %v invalid, %v", args[2], err)
+	}
+	SetSetHandleTTL(parseTTL)
+
+	return nil
+}
+
+var ruleOptionKeywords = map[string]bool{
+	"domain":          true,
+	"resolve":         true,
+	"from":            true,
+	"qtype":           true,
+	"rcode":           true,
+	"require":         true,
+	"exclude-cidr":    true,
+	"geoip":           true,
+	"asn":             true,
+	"unless-in":       true,
+	"exclusive-group": true,
+	"priority":        true,
+	"comment":         true,
+	"netns":           true,
+}
+
+// ruleOptionValues returns the values of a rule option, which end at the next option keyword
+func ruleOptionValues(args []string) []string {
+	for i, arg := range args {
+		if ruleOptionKeywords[strings.ToLower(arg)] {
+			return args[:i]
+		}
+	}
+	return args
+}
+
+func setupRuleOptions(c *caddy.Controller, handle *NftablesHandler, rule *NftablesSetAddElement, args []string) error {
+	for i := 0; i < len(args); {
+		option := strings.ToLower(args[i])
+		if !ruleOptionKeywords[option] {
+			log.Warningf("Ignore invalid setting %s", args[i])
+			i += 1
+			continue
+		}
+
+		values := ruleOptionValues(args[i+1:])
+		if len(values) == 0 {
+			return c.Errf("nftables set rule option %v requires at least one value", option)
+		}
+		i += 1 + len(values)
+
+		switch option {
+		case "domain":
+			for _, domain := range values {
+				rule.Domains = append(rule.Domains, plugin.Name(domain).Normalize())
+			}
+		case "from":
+			for _, from := range values {
+				network, err := parseNetwork(from)
+				if err != nil {
+					return c.Errf("nftables set rule option from %v invalid, %v", from, err)
+				}
+				rule.Clients = append(rule.Clients, network)
+			}
+		case "qtype":
+			for _, qtype := range values {
+				value, ok := dns.StringToType[strings.ToUpper(qtype)]
+				if !ok {
+					return c.Errf("nftables set rule option qtype %v invalid", qtype)
+				}
+				rule.QTypes = append(rule.QTypes, value)
+			}
+		case "rcode":
+			for _, rcode := range values {
+				value, ok := dns.StringToRcode[strings.ToUpper(rcode)]
+				if !ok {
+					return c.Errf("nftables set rule option rcode %v invalid", rcode)
+				}
+				rule.Rcodes = append(rule.Rcodes, value)
+			}
+		case "require":
+			if strings.ToLower(values[0]) != "validated" || len(values) > 2 {
+				return c.Errf("nftables set rule option require %v invalid, only validated [metadata label] is supported", values)
+			}
+			rule.RequireValidated = true
+			if len(values) > 1 {
+				rule.ValidatedMetadata = values[1]
+			}
+		case "exclude-cidr":
+			networks, err := parseExcludeNetworks(values)
+			if err != nil {
+				return c.Errf("nftables set rule option %v", err)
+			}
+			rule.Excludes = append(rule.Excludes, networks...)
+		case "geoip":
+			rule.GeoIPFilter.AddCountries(values)
+			rule.GeoIP = handle.GeoIP
+		case "asn":
+			if err := rule.GeoIPFilter.AddASNs(values); err != nil {
+				return c.Errf("nftables set rule option %v", err)
+			}
+			rule.GeoIP = handle.GeoIP
+		case "unless-in":
+			if len(values)%2 != 0 {
+				return c.Errf("nftables set rule option unless-in %v invalid, should be <TABLE_NAME> <SET_NAME> pairs", values)
+			}
+			for j := 0; j < len(values); j += 2 {
+				rule.UnlessIn = append(rule.UnlessIn, NftablesSetReference{TableName: values[j], SetName: values[j+1]})
+			}
+		case "comment":
+			rule.Comment = strings.Join(values, " ")
+		case "netns":
+			netns, err := parseNetns(values)
+			if err != nil {
+				return c.Errf("nftables set rule option %v", err)
+			}
+			rule.Netns = netns
+		case "exclusive-group":
+			if len(values) != 1 {
+				return c.Errf("nftables set rule option exclusive-group %v invalid, only one group is supported", values)
+			}
+			rule.ExclusiveGroup = values[0]
+		case "priority":
+			priority, err := strconv.Atoi(values[0])
+			if err != nil || len(values) != 1 {
+				return c.Errf("nftables set rule option priority %v invalid, %v", values, err)
+			}
+			rule.Priority = priority
+		case "resolve":
+			for _, resolve := range values {
+				switch strings.ToLower(resolve) {
+				case "mx":
+					rule.Resolve = append(rule.Resolve, dns.TypeMX)
+				case "ns":
+					rule.Resolve = append(rule.Resolve, dns.TypeNS)
+				default:
+					return c.Errf("nftables set rule option resolve %v invalid, only mx and ns are supported", resolve)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseNetwork parses a CIDR, or a single address as a host network
+func parseNetwork(value string) (*net.IPNet, error) {
+	if !strings.ContainsRune(value, '/') {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %v", value)
+		}
+		return hostNetwork(ip), nil
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
@@ -1,9 +1,16 @@
 package coredns_nftables
 
 import (
+	"context"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/google/nftables"
+	"github.com/miekg/dns"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestSetup(t *testing.T) {
@@ -17,3 +24,264 @@ func TestSetup(t *testing.T) {
 		t.Fatalf("Expected errors, but got: %v", err)
 	}
 }
+
+func TestSetupDomainOption(t *testing.T) {
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		set add element filter IPSET ip false 24h domain Example.org example.net
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	rule := handle.MutableRuleSet(nftables.TableFamilyIPv4).RuleAddElement[0]
+	if len(rule.Domains) != 2 || rule.Domains[0] != "example.org." {
+		t.Fatalf("Expected domains [example.org. example.net.], but got: %v", rule.Domains)
+	}
+	if !rule.MatchDomain("www.example.org.") || rule.MatchDomain("example.com.") {
+		t.Fatalf("Unexpected domain matching result of %v", rule.Domains)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		set add element filter MAILSET ip false 24h domain example.org resolve mx NS
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	rule = handle.MutableRuleSet(nftables.TableFamilyIPv4).RuleAddElement[1]
+	if !rule.MatchResolve(dns.TypeMX) || !rule.MatchResolve(dns.TypeNS) || len(rule.Domains) != 1 {
+		t.Fatalf("Unexpected rule options %v, %v", rule.Resolve, rule.Domains)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		set add element filter IPSET ip domain
+	}`)
+	if err := parse(c, &handle); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+}
+
+func TestSetupDomainOptionReverse(t *testing.T) {
+	ruleset := withMemoryBackend(t)
+
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		set add element filter IPSET ip false domain example.org
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	// Only handlers with domain rules serve PTR answers
+	ptr := &dns.PTR{Hdr: dns.RR_Header{Name: "1.2.0.192.in-addr.arpa.", Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60}, Ptr: "www.example.org."}
+	noDomain := NewNftablesHandler()
+	if err := parse(caddy.NewTestController("dns", `nftables ip {
+		set add element filter IPSET ip false
+	}`), &noDomain); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if !handle.isValidAnswer(ptr) || noDomain.isValidAnswer(ptr) {
+		t.Fatalf("Expected PTR answers only valid with domain rules")
+	}
+
+	// The address in the name of a reverse lookup is added when the PTR answer matches the rule
+	for _, testCase := range []struct {
+		name   string
+		ptr    string
+		ip     string
+		expect bool
+	}{
+		{"1.2.0.192.in-addr.arpa.", "www.example.org.", "192.0.2.1", true},
+		{"2.2.0.192.in-addr.arpa.", "example.com.", "192.0.2.2", false},
+	} {
+		r := new(dns.Msg)
+		r.SetQuestion(testCase.name, dns.TypePTR)
+		r.Answer = append(r.Answer, &dns.PTR{Hdr: dns.RR_Header{Name: testCase.name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60}, Ptr: testCase.ptr})
+		if _, err := handle.ServeWorker(context.Background(), r, hostNetwork(net.ParseIP("127.0.0.1"))); err != nil {
+			t.Fatalf("Expected no errors, but got: %v", err)
+		}
+		if ruleset.Contains(nftables.TableFamilyIPv4, "filter", "IPSET", net.ParseIP(testCase.ip)) != testCase.expect {
+			t.Fatalf("Expected element %v in IPSET to be %v", testCase.ip, testCase.expect)
+		}
+	}
+}
+
+func TestSetupClientRule(t *testing.T) {
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip ip6 {
+		set add client filter TELEMETRY_CLIENTS auto 1h domain telemetry.example.org from 192.168.10.0/24 fd00::1
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	if !handle.hasClientRule() || len(handle.MutableRuleSet(nftables.TableFamilyIPv6).RuleAddClient) != 1 {
+		t.Fatalf("Expected client rules of ip and ip6")
+	}
+	if rule := handle.MutableRuleSet(nftables.TableFamilyIPv4).RuleAddClient[0]; rule.Timeout != time.Hour || rule.SetName != "TELEMETRY_CLIENTS" {
+		t.Fatalf("Unexpected client rule %v", rule)
+	}
+	rule := handle.MutableRuleSet(nftables.TableFamilyIPv6).RuleAddClient[0]
+	query := func(name string, client string) *NftablesQuery {
+		return &NftablesQuery{Name: name, QType: dns.TypeA, Client: hostNetwork(net.ParseIP(client))}
+	}
+	if !rule.Match(context.Background(), query("telemetry.example.org.", "192.168.10.7")) || !rule.Match(context.Background(), query("telemetry.example.org.", "fd00::1")) ||
+		rule.Match(context.Background(), query("telemetry.example.org.", "192.168.11.7")) || rule.Match(context.Background(), query("example.org.", "fd00::1")) {
+		t.Fatalf("Unexpected client matching result of %v", rule.Clients)
+	}
+}
+
+func TestSetupResponseFilter(t *testing.T) {
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		set add element filter IPSET ip false 24h qtype A https rcode NOERROR
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	if !handle.matchAnyResponse(&NftablesQuery{QType: dns.TypeHTTPS, Rcode: dns.RcodeSuccess}) ||
+		handle.matchAnyResponse(&NftablesQuery{QType: dns.TypeTXT, Rcode: dns.RcodeSuccess}) ||
+		handle.matchAnyResponse(&NftablesQuery{QType: dns.TypeA, Rcode: dns.RcodeNameError}) {
+		t.Fatalf("Unexpected response matching result")
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		set add element filter IPSET ip qtype UNKNOWN_TYPE
+	}`)
+	if err := parse(c, &handle); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+}
+
+func TestSetupRequireValidated(t *testing.T) {
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		set add element filter IPSET ip false 24h require validated dnssec/validated
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	rule := handle.MutableRuleSet(nftables.TableFamilyIPv4).RuleAddElement[0]
+	if rule.Match(context.Background(), &NftablesQuery{Name: "example.org."}) {
+		t.Fatalf("Expected unvalidated response rejected")
+	}
+	if !rule.Match(context.Background(), &NftablesQuery{Name: "example.org.", AuthenticatedData: true}) {
+		t.Fatalf("Expected response with AD bit accepted")
+	}
+
+	ctx := metadata.ContextWithMetadata(context.Background())
+	metadata.SetValueFunc(ctx, "dnssec/validated", func() string { return "true" })
+	if !rule.Match(ctx, &NftablesQuery{Name: "example.org."}) {
+		t.Fatalf("Expected response marked by metadata accepted")
+	}
+
+	// A response is only counted once by the rule, for all of its answers and families
+	counter := func() float64 {
+		var metric dto.Metric
+		unvalidatedCount.WithLabelValues("").Write(&metric)
+		return metric.GetCounter().GetValue()
+	}
+	before := counter()
+	r := new(dns.Msg)
+	r.SetQuestion("example.org.", dns.TypeA)
+	query := NewNftablesQuery(r, hostNetwork(net.ParseIP("127.0.0.1")))
+	for i := 0; i < 3; i++ {
+		if rule.Match(context.Background(), query) {
+			t.Fatalf("Expected unvalidated response rejected")
+		}
+	}
+	if counter()-before != 1 {
+		t.Fatalf("Expected the response counted once, but got: %v", counter()-before)
+	}
+}
+
+func TestSetupExcludeCidr(t *testing.T) {
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		set add element filter IPSET ip false 24h exclude-cidr private 203.0.113.0/24 domain example.org
+		exclude-cidr bogon
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	if !handle.isExcludedAddress(net.ParseIP("0.0.0.0")) || !handle.isExcludedAddress(net.ParseIP("fe80::1")) ||
+		handle.isExcludedAddress(net.ParseIP("1.1.1.1")) {
+		t.Fatalf("Unexpected excluded addresses of block")
+	}
+
+	rule := handle.MutableRuleSet(nftables.TableFamilyIPv4).RuleAddElement[0]
+	if !networksContain(rule.Excludes, net.ParseIP("192.168.1.1")) || !networksContain(rule.Excludes, net.ParseIP("203.0.113.9")) ||
+		networksContain(rule.Excludes, net.ParseIP("8.8.8.8")) || len(rule.Domains) != 1 {
+		t.Fatalf("Unexpected excluded addresses of rule %v", rule.Excludes)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		exclude-cidr unknown-class
+	}`)
+	if err := parse(c, &handle); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+}
+
+func TestSetupGeoIPFilter(t *testing.T) {
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables inet {
+		set add element fw proxy ip geoip !CN asn AS13335 !4134
+	}`)
+	if err := parse(c, &handle); err == nil {
+		t.Fatalf("Expected errors without databases, but got: %v", err)
+	}
+
+	c = caddy.NewTestController("dns", `nftables inet {
+		geoip database /nonexistent/GeoLite2-Country.mmdb
+	}`)
+	if err := parse(c, &handle); err == nil {
+		t.Fatalf("Expected errors with invalid database, but got: %v", err)
+	}
+
+	filter := NftablesGeoIPFilter{}
+	filter.AddCountries([]string{"!cn"})
+	if err := filter.AddASNs([]string{"AS13335", "!4134"}); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+	if !filter.Match("US", 13335) || filter.Match("CN", 13335) || filter.Match("US", 4134) || filter.Match("", 0) {
+		t.Fatalf("Unexpected GeoIP matching result of %v", filter)
+	}
+}
+
+func TestSetupExclusiveGroup(t *testing.T) {
+	handle := NewNftablesHandler()
+	c := caddy.NewTestController("dns", `nftables ip {
+		set add element fw direct ip false exclusive-group route
+		set add element fw proxy ip false exclusive-group route priority 10 domain example.org
+		set add element fw vpn ip false exclusive-group route priority 10
+		set add element fw log ip false
+	}`)
+	if err := parse(c, &handle); err != nil {
+		t.Fatalf("Expected no errors, but got: %v", err)
+	}
+
+	rules := handle.MutableRuleSet(nftables.TableFamilyIPv4).RuleAddElement
+	apply, remove := selectExclusiveRules(rules, rules)
+	if len(apply) != 2 || apply[0].SetName != "proxy" || apply[1].SetName != "log" {
+		t.Fatalf("Unexpected applied rules %v", apply)
+	}
+	if len(remove) != 2 || remove[0].SetName != "direct" || remove[1].SetName != "vpn" {
+		t.Fatalf("Unexpected removed rules %v", remove)
+	}
+
+	apply, remove = selectExclusiveRules(rules, []*NftablesSetAddElement{rules[3]})
+	if len(apply) != 1 || len(remove) != 0 {
+		t.Fatalf("Unexpected rules without matched group %v %v", apply, remove)
+	}
+
+	c = caddy.NewTestController("dns", `nftables ip {
+		set add element fw direct ip false priority high
+	}`)
+	if err := parse(c, &handle); err == nil {
+		t.Fatalf("Expected errors, but got: %v", err)
+	}
+}